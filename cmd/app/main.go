@@ -1,30 +1,119 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"flag"
 	"log"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
+	"time"
 
+	aggregator "github.com/debojitroy/aws-queue-tasks-consume/internal/services/aggregator"
+	dynamodb "github.com/debojitroy/aws-queue-tasks-consume/internal/services/aws/dynamodb"
 	kinesis "github.com/debojitroy/aws-queue-tasks-consume/internal/services/aws/kinesis"
 	sqs "github.com/debojitroy/aws-queue-tasks-consume/internal/services/aws/sqs"
+	blobstore "github.com/debojitroy/aws-queue-tasks-consume/internal/services/blobstore"
+	message "github.com/debojitroy/aws-queue-tasks-consume/internal/services/message"
+	scheduler "github.com/debojitroy/aws-queue-tasks-consume/internal/services/scheduler"
+	tracing "github.com/debojitroy/aws-queue-tasks-consume/internal/services/tracing"
 	worker "github.com/debojitroy/aws-queue-tasks-consume/internal/services/worker"
 	color "github.com/fatih/color"
 )
 
 func main() {
+	// Subcommands manage the AWS resources and report on runs, without one
+	// the migration runs
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "bootstrap":
+			bootstrap(os.Args[2:])
+			return
+		case "teardown":
+			teardown(os.Args[2:])
+			return
+		case "status":
+			status(os.Args[2:])
+			return
+		}
+	}
+
 	_entity_count_ptr := flag.Int("entity_count", 2, "Number of entities to generate")
 	_region_ptr := flag.String("region", "", "AWS Region")
 	_ddb_table_ptr := flag.String("ddb_table", "", "DynamoDB Table Name")
+	_retention_ptr := flag.Duration("retention", 7*24*time.Hour, "Time after which entity items and processed-message markers expire through the table TTL (0 to keep them)")
+	_finished_retention_ptr := flag.Duration("finished_retention", 24*time.Hour, "Time entity items are kept once completed, failed or cancelled, if shorter than the retention (0 to keep the retention)")
+	_run_id_ptr := flag.String("run_id", "", "Identifier of this run, scoping its entities in the table (defaults to the start time and a random suffix)")
 	_entity_queue_url_ptr := flag.String("queue_url", "", "SQS Queue URL")
+	_consumer_queues_ptr := flag.String("consumer_queues", "", "Comma separated SQS Queue URLs to consume from, as url or url=weight, highest priority first (defaults to queue_url)")
+	_poll_strategy_ptr := flag.String("poll_strategy", "weighted", "How consumer queues are polled: weighted or strict")
 	_kinesis_stream_name_ptr := flag.String("kinesis_stream_name", "", "Kinesis Stream Name")
+	_ledger_table_ptr := flag.String("ledger_table", "", "DynamoDB Table Name recording processed messages (enables idempotent consumption)")
+	_coalesce_window_ptr := flag.Duration("coalesce_window", 0, "Window in which message count decrements of an entity are coalesced into one write (0 to disable, ignored with ledger_table)")
+	_coalesce_max_ptr := flag.Int("coalesce_max", 0, "Decrements after which a coalesced write is made before the window ends (0 for no limit)")
+	_visibility_timeout_ptr := flag.Int("visibility_timeout", 30, "SQS visibility timeout in seconds")
+	_heartbeat_interval_ptr := flag.Duration("heartbeat_interval", 10*time.Second, "Interval to extend visibility of in-flight messages (0 to disable)")
+	_max_receive_count_ptr := flag.Int("max_receive_count", 5, "Receives after which a failing message is quarantined (0 to retry forever)")
+	_dlq_url_ptr := flag.String("dlq_url", "", "SQS Dead-Letter Queue URL for quarantined messages")
+	_num_workers_ptr := flag.Int("num_workers", 3, "Number of SQS workers")
+	_num_processors_ptr := flag.Int("num_processors", 10, "Number of SQS messages processed concurrently")
+	_buffer_size_ptr := flag.Int("buffer_size", 20, "Number of received SQS messages waiting for processing")
+	_handler_timeout_ptr := flag.Duration("handler_timeout", 5*time.Minute, "Maximum time to process a single SQS message")
+	_autoscale_ptr := flag.Bool("autoscale", false, "Scale SQS workers with the queue depth")
+	_min_workers_ptr := flag.Int("min_workers", 0, "Minimum number of SQS workers when autoscaling")
+	_max_workers_ptr := flag.Int("max_workers", 10, "Maximum number of SQS workers when autoscaling")
+	_claim_check_bucket_ptr := flag.String("claim_check_bucket", "", "S3 Bucket for oversized message bodies")
+	_claim_check_dir_ptr := flag.String("claim_check_dir", "", "Local directory for oversized message bodies (development only)")
+	_claim_check_threshold_ptr := flag.Int("claim_check_threshold", 0, "Message size in bytes above which bodies are claim-checked (0 for the SQS limit)")
+	_entity_delay_ptr := flag.Duration("entity_delay", 0, "Delay before the messages of each entity are delivered")
+	_message_stagger_ptr := flag.Duration("message_stagger", 0, "Additional delivery delay between consecutive messages of an entity")
+	_schedule_dir_ptr := flag.String("schedule_dir", "", "Local directory persisting messages scheduled beyond the SQS delay limit (required for such delays and for any delay on FIFO queues)")
+	_codec_ptr := flag.String("codec", "json", "Message codec: json, binary or gzip-json")
+	_trace_exporter_ptr := flag.String("trace_exporter", "none", "Trace exporter: none, otlp or file")
+	_trace_file_ptr := flag.String("trace_file", "traces.json", "File receiving spans as JSON with the file trace exporter")
+	_otlp_endpoint_ptr := flag.String("otlp_endpoint", "", "OTLP/HTTP collector host:port (defaults to OTEL_EXPORTER_OTLP_ENDPOINT)")
+	_unknown_message_type_ptr := flag.String("unknown_message_type", "dlq", "Handling of messages without a handler for their type: dlq, drop or retry")
 
 	flag.Parse()
 
 	_entity_count := *_entity_count_ptr
 	_region := *_region_ptr
 	_ddb_table := *_ddb_table_ptr
+	_run_id := *_run_id_ptr
+	_retention := *_retention_ptr
+	_finished_retention := *_finished_retention_ptr
 	_entity_queue_url := *_entity_queue_url_ptr
+	_consumer_queues := *_consumer_queues_ptr
+	_poll_strategy := *_poll_strategy_ptr
 	_kinesis_stream_name := *_kinesis_stream_name_ptr
+	_ledger_table := *_ledger_table_ptr
+	_coalesce_window := *_coalesce_window_ptr
+	_coalesce_max := *_coalesce_max_ptr
+	_visibility_timeout := *_visibility_timeout_ptr
+	_heartbeat_interval := *_heartbeat_interval_ptr
+	_max_receive_count := *_max_receive_count_ptr
+	_dlq_url := *_dlq_url_ptr
+	_num_workers := *_num_workers_ptr
+	_num_processors := *_num_processors_ptr
+	_buffer_size := *_buffer_size_ptr
+	_handler_timeout := *_handler_timeout_ptr
+	_autoscale := *_autoscale_ptr
+	_min_workers := *_min_workers_ptr
+	_max_workers := *_max_workers_ptr
+	_claim_check_bucket := *_claim_check_bucket_ptr
+	_claim_check_dir := *_claim_check_dir_ptr
+	_claim_check_threshold := *_claim_check_threshold_ptr
+	_codec := *_codec_ptr
+	_unknown_message_type := *_unknown_message_type_ptr
+	_trace_exporter := *_trace_exporter_ptr
+	_trace_file := *_trace_file_ptr
+	_otlp_endpoint := *_otlp_endpoint_ptr
+	_entity_delay := *_entity_delay_ptr
+	_message_stagger := *_message_stagger_ptr
+	_schedule_dir := *_schedule_dir_ptr
 
 	if _region == "" {
 		log.Fatal("Region is required")
@@ -42,23 +131,142 @@ func main() {
 		log.Fatal("Kinesis Stream Name is required")
 	}
 
+	if _run_id == "" {
+		_run_id = newRunId(time.Now())
+	}
+
+	codec, err := message.CodecByName(_codec)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	consumerQueues, err := sqs.ParseQueueConfigs(_consumer_queues)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	unknownMessageType, err := sqs.UnknownTypePolicyByName(_unknown_message_type)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if _claim_check_bucket != "" && _claim_check_dir != "" {
+		log.Fatal("Only one of Claim Check Bucket and Claim Check Directory can be set")
+	}
+
 	c := color.New(color.FgHiYellow)
 	cErr := color.New(color.FgRed).Add(color.Bold)
 
+	// The application stops on SIGINT/SIGTERM, once all entities are
+	// migrated, or when one of the consumers fails
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	shutdownTracing, err := tracing.Setup(ctx, tracing.Config{
+		ServiceName: "aws-queue-tasks-consume",
+		Exporter:    _trace_exporter,
+		Endpoint:    _otlp_endpoint,
+		File:        _trace_file,
+	})
+	if err != nil {
+		log.Fatalf("Error setting up tracing: %v", err)
+	}
+
 	// Start Producer
-	c.Println("Starting Producer")
+	c.Printf("Starting Producer for run %s \n", _run_id)
+
+	var claimCheckStore blobstore.Store
+	if _claim_check_bucket != "" {
+		claimCheckStore, err = blobstore.NewS3Store(_region, _claim_check_bucket, "claim-check/")
+	} else if _claim_check_dir != "" {
+		claimCheckStore, err = blobstore.NewFileStore(_claim_check_dir)
+	}
+	if err != nil {
+		cErr.Printf("Error creating claim check store: %+v \n", err)
+		log.Fatalf("Error creating claim check store: %v", err)
+	}
+
+	// Messages delayed beyond what SQS supports wait in the scheduler store.
+	// It has to outlive the process, as the delayed messages are already
+	// part of the message count.
+	var schedulerStore scheduler.Store
+	if _schedule_dir != "" {
+		schedulerStore, err = scheduler.NewFileStore(_schedule_dir)
+		if err != nil {
+			cErr.Printf("Error creating scheduler store: %+v \n", err)
+			log.Fatalf("Error creating scheduler store: %v", err)
+		}
+	}
 
 	entityProducerConfig := &worker.EntityProducerConfig{
 		Region:    _region,
 		QueueUrl:  _entity_queue_url,
 		TableName: _ddb_table,
+
+		ClaimCheckStore:     claimCheckStore,
+		ClaimCheckThreshold: _claim_check_threshold,
+
+		RunId: _run_id,
+		Codec: codec,
+
+		EntityDelay:    _entity_delay,
+		MessageStagger: _message_stagger,
+		SchedulerStore: schedulerStore,
+
+		Retention:         _retention,
+		FinishedRetention: _finished_retention,
 	}
 
-	worker.GenerateRandomEntities(_entity_count, entityProducerConfig)
+	worker.GenerateRandomEntities(ctx, _entity_count, entityProducerConfig)
 
 	c.Println("Completing Producer")
 
 	var wg sync.WaitGroup
+	var errMu sync.Mutex
+	var errs []error
+
+	// fail records the error of a consumer and stops the application
+	fail := func(name string, err error) {
+		cErr.Printf("%s failed: %+v \n", name, err)
+
+		errMu.Lock()
+		errs = append(errs, err)
+		errMu.Unlock()
+
+		cancel()
+	}
+
+	// Start the Scheduler for messages with long delays
+	if schedulerStore != nil {
+		c.Println("Starting Scheduler")
+		sqsClient, err := sqs.NewSQSClient(_region, _entity_queue_url)
+		if err != nil {
+			cErr.Printf("Error creating SQS client: %+v \n", err)
+			log.Fatalf("Error creating SQS client: %v", err)
+		}
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			if err := scheduler.NewScheduler(schedulerStore, sqsClient, 0).Run(ctx); err != nil {
+				fail("Scheduler", err)
+			}
+		}()
+	}
+
+	// Clients shared by the consumers
+	ddb, err := dynamodb.NewDynamoDBClient(_region, _ddb_table)
+	if err != nil {
+		cErr.Printf("Error creating DynamoDB client: %+v \n", err)
+		log.Fatalf("Error creating DynamoDB client: %v", err)
+	}
+	if _retention > 0 {
+		ddb.ExpireFinishedAfter(_finished_retention)
+	}
 
 	// Start the Kinesis Stream Consumer
 	c.Println("Starting Kinesis Stream Consumer")
@@ -72,25 +280,117 @@ func main() {
 
 	go func() {
 		defer wg.Done()
-		consumer.StartKinesisStreamProcessor(worker.MigrationTrackerHandler)
+		if err := consumer.Run(ctx, worker.NewMigrationTrackerHandler(_run_id, ddb, cancel)); err != nil {
+			fail("Kinesis Stream Consumer", err)
+		}
 	}()
 
 	c.Println("Starting SQS Consumer")
 
+	handlerMetrics := &sqs.HandlerMetrics{}
+
+	// Handlers wait for coalesced writes, so the number of concurrently
+	// processed messages bounds how many decrements can be coalesced
+	var counters sqs.CounterStore = ddb
+	var coalescer *aggregator.Aggregator
+	if _coalesce_window > 0 {
+		coalescer = aggregator.New(ddb, _coalesce_window, _coalesce_max)
+		counters = coalescer
+	}
+
+	dependencies := &sqs.Dependencies{
+		Counters: counters,
+		Logger:   log.New(os.Stdout, "[sqs] ", log.LstdFlags),
+		Metrics:  handlerMetrics,
+	}
+
+	var messageHandler sqs.Handler = worker.EntityMessageConsumer
+	if _ledger_table != "" {
+		// Markers are kept as long as the entities they count down
+		ledger := dynamodb.NewLedger(ddb, _ledger_table)
+		ledger.ExpireAfter(_retention)
+		messageHandler = worker.NewEntityMessageConsumer(ledger)
+	}
+
+	// Route messages by type, entity messages must identify their entity
+	router := sqs.NewRouter(unknownMessageType).
+		Handle(message.EntityMessageType, messageHandler,
+			sqs.ValidateAttributes(sqs.EntityIdAttribute, sqs.MessageIdAttribute))
+
 	sqsConfig := &sqs.Config{
-		TableName:       _ddb_table,
+		Region:          _region,
 		QueueURL:        _entity_queue_url,
-		NumWorkers:      3,
+		Queues:          consumerQueues,
+		PollStrategy:    sqs.PollStrategy(_poll_strategy),
+		NumWorkers:      _num_workers,
 		BatchSize:       10,
 		WaitTimeSeconds: 20,
+		NumProcessors:   _num_processors,
+		BufferSize:      _buffer_size,
+
+		VisibilityTimeout: int32(_visibility_timeout),
+		HeartbeatInterval: _heartbeat_interval,
+
+		MaxReceiveCount:    int32(_max_receive_count),
+		DeadLetterQueueURL: _dlq_url,
+
+		CircuitBreakerThreshold: 10,
+
+		ClaimCheckStore: claimCheckStore,
+
+		Dependencies: dependencies,
+
+		Middlewares: []sqs.Middleware{
+			sqs.Logging(),
+			sqs.Metrics(handlerMetrics),
+			sqs.Recover(),
+			sqs.Timeout(_handler_timeout),
+		},
+	}
+
+	if _autoscale {
+		sqsConfig.Autoscale = &sqs.AutoscaleConfig{
+			MinWorkers: _min_workers,
+			MaxWorkers: _max_workers,
+		}
 	}
 
 	wg.Add(1)
 
 	go func() {
 		defer wg.Done()
-		sqs.StartSqsConsumer(worker.EntityMessageConsumer, sqsConfig)
+		if err := sqs.StartSqsConsumer(ctx, router.Handler(), sqsConfig); err != nil {
+			fail("SQS Consumer", err)
+		}
+		c.Printf("SQS Consumer metrics: %s \n", handlerMetrics)
+		if coalescer != nil {
+			c.Printf("Coalesced message counts: %s \n", coalescer)
+		}
+		if dropped := router.DroppedCounts(); len(dropped) > 0 {
+			c.Printf("Dropped messages of unknown types: %v \n", dropped)
+		}
 	}()
 
 	wg.Wait()
+
+	// Flush pending spans, log.Fatalf below skips deferred calls
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), 10*time.Second)
+	if err := shutdownTracing(flushCtx); err != nil {
+		cErr.Printf("Error flushing traces: %+v \n", err)
+	}
+	cancelFlush()
+
+	if len(errs) > 0 {
+		log.Fatalf("Stopped with errors: %v", errs)
+	}
+}
+
+// newRunId returns a run id made of the start time and a random suffix, so
+// that producers started in the same second do not share a run
+func newRunId(start time.Time) string {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		log.Fatalf("Failed to generate a run id: %v", err)
+	}
+	return start.UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix)
 }
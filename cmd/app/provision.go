@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"strings"
+
+	provision "github.com/debojitroy/aws-queue-tasks-consume/internal/services/aws/provision"
+	color "github.com/fatih/color"
+)
+
+// provisionFlags parses the flags shared by the bootstrap and teardown
+// subcommands
+func provisionFlags(name string, args []string) *provision.Config {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+
+	_region_ptr := flags.String("region", "", "AWS Region")
+	_endpoint_ptr := flags.String("endpoint", "", "Custom AWS endpoint, e.g. http://localhost:4566 for LocalStack")
+	_queue_name_ptr := flags.String("queue_name", "entity-messages", "SQS Queue Name (a .fifo suffix creates FIFO queues)")
+	_dlq_name_ptr := flags.String("dlq_name", "", "SQS Dead-Letter Queue Name (defaults to the queue name with a -dlq suffix)")
+	_max_receive_count_ptr := flags.Int("max_receive_count", 5, "Receives after which SQS moves a message to the dead-letter queue (0 for no redrive policy)")
+	_visibility_timeout_ptr := flags.Int("visibility_timeout", 30, "SQS visibility timeout in seconds")
+	_ddb_table_ptr := flags.String("ddb_table", "entity-messages", "DynamoDB Table Name")
+	_ledger_table_ptr := flags.String("ledger_table", "", "DynamoDB Table Name recording processed messages (optional)")
+	_kinesis_stream_name_ptr := flags.String("kinesis_stream_name", "entity-messages", "Kinesis Stream Name")
+	_shard_count_ptr := flags.Int("shard_count", 1, "Number of Kinesis shards")
+
+	flags.Parse(args)
+
+	_region := *_region_ptr
+	_queue_name := *_queue_name_ptr
+	_dlq_name := *_dlq_name_ptr
+
+	if _region == "" {
+		log.Fatal("Region is required")
+	}
+
+	if _dlq_name == "" {
+		_dlq_name = strings.TrimSuffix(_queue_name, ".fifo") + "-dlq"
+		if provision.IsFifo(_queue_name) {
+			_dlq_name += ".fifo"
+		}
+	}
+
+	return &provision.Config{
+		Region:              _region,
+		Endpoint:            *_endpoint_ptr,
+		QueueName:           _queue_name,
+		DeadLetterQueueName: _dlq_name,
+		MaxReceiveCount:     *_max_receive_count_ptr,
+		VisibilityTimeout:   *_visibility_timeout_ptr,
+		TableName:           *_ddb_table_ptr,
+		LedgerTableName:     *_ledger_table_ptr,
+		StreamName:          *_kinesis_stream_name_ptr,
+		ShardCount:          int32(*_shard_count_ptr),
+	}
+}
+
+// bootstrap creates the queues, tables and stream and prints how to run
+// against them
+func bootstrap(args []string) {
+	c := color.New(color.FgHiYellow)
+
+	cfg := provisionFlags("bootstrap", args)
+
+	provisioner, err := provision.NewProvisioner(*cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	resources, err := provisioner.Bootstrap(context.Background())
+	if err != nil {
+		log.Fatalf("Bootstrap failed: %v", err)
+	}
+
+	c.Println("All resources are ready, run with:")
+
+	command := []string{os.Args[0],
+		"-region=" + cfg.Region,
+		"-ddb_table=" + cfg.TableName,
+		"-queue_url=" + resources.QueueURL,
+		"-dlq_url=" + resources.DeadLetterQueueURL,
+		"-kinesis_stream_name=" + cfg.StreamName,
+	}
+	if cfg.LedgerTableName != "" {
+		command = append(command, "-ledger_table="+cfg.LedgerTableName)
+	}
+	if cfg.Endpoint != "" {
+		command = append([]string{"AWS_ENDPOINT_URL=" + cfg.Endpoint}, command...)
+	}
+	c.Println(strings.Join(command, " "))
+}
+
+// teardown deletes everything bootstrap created
+func teardown(args []string) {
+	c := color.New(color.FgHiYellow)
+
+	provisioner, err := provision.NewProvisioner(*provisionFlags("teardown", args))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := provisioner.Teardown(context.Background()); err != nil {
+		log.Fatalf("Teardown failed: %v", err)
+	}
+
+	c.Println("All resources are deleted")
+}
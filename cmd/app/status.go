@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	dynamodb "github.com/debojitroy/aws-queue-tasks-consume/internal/services/aws/dynamodb"
+	report "github.com/debojitroy/aws-queue-tasks-consume/internal/services/report"
+)
+
+// status prints the progress of a run, once or periodically
+func status(args []string) {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+
+	_region_ptr := flags.String("region", "", "AWS Region")
+	_ddb_table_ptr := flags.String("ddb_table", "", "DynamoDB Table Name")
+	_run_id_ptr := flags.String("run_id", "", "Identifier of the run to report on")
+	_format_ptr := flags.String("format", report.FormatTable, "Output format: table, json or csv")
+	_stuck_after_ptr := flags.Duration("stuck_after", 5*time.Minute, "Time without progress, after its delayed messages are due, after which an unfinished entity is reported as stuck")
+	_watch_ptr := flags.Bool("watch", false, "Refresh the report periodically until interrupted")
+	_interval_ptr := flags.Duration("interval", 5*time.Second, "Refresh interval with -watch")
+
+	flags.Parse(args)
+
+	_region := *_region_ptr
+	_ddb_table := *_ddb_table_ptr
+	_run_id := *_run_id_ptr
+	_format := *_format_ptr
+	_stuck_after := *_stuck_after_ptr
+	_watch := *_watch_ptr
+	_interval := *_interval_ptr
+
+	if _region == "" {
+		log.Fatal("Region is required")
+	}
+
+	if _ddb_table == "" {
+		log.Fatal("DynamoDB Table Name is required")
+	}
+
+	if _run_id == "" {
+		log.Fatal("Run Id is required")
+	}
+
+	switch _format {
+	case report.FormatTable, report.FormatJSON, report.FormatCSV:
+	default:
+		log.Fatalf("Unknown output format %q", _format)
+	}
+
+	ddb, err := dynamodb.NewDynamoDBClient(_region, _ddb_table)
+	if err != nil {
+		log.Fatalf("Error creating DynamoDB client: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	ticker := time.NewTicker(_interval)
+	defer ticker.Stop()
+
+	for {
+		entities, err := ddb.ListRunEntities(ctx, _run_id)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Fatalf("Error querying run %s: %v", _run_id, err)
+		}
+
+		// Redraw tables in place, other formats are streamed
+		if _watch && _format == report.FormatTable {
+			fmt.Print("\033[H\033[2J")
+		}
+
+		r := report.Build(_run_id, entities, _stuck_after, time.Now())
+		if err := r.Write(os.Stdout, _format); err != nil {
+			log.Fatalf("Error writing report: %v", err)
+		}
+
+		if !_watch {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package aggregator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	dynamodb "github.com/debojitroy/aws-queue-tasks-consume/internal/services/aws/dynamodb"
+)
+
+// Store applies message count decrements, e.g. *dynamodb.DynamoDBClient
+type Store interface {
+	DecrementMessageCount(ctx context.Context, runId string, entityId string, decrementCount int) error
+}
+
+// Aggregator coalesces the decrements of an entity made within a short
+// window into a single write. DecrementMessageCount blocks until the write
+// covering the decrement finished, so callers only acknowledge their message
+// once it is counted. It is safe for concurrent use.
+type Aggregator struct {
+	store       Store
+	window      time.Duration
+	maxMessages int
+
+	mu      sync.Mutex
+	pending map[string]*batch
+
+	writes     atomic.Int64
+	decrements atomic.Int64
+}
+
+// batch collects the decrements of one entity until it is flushed
+type batch struct {
+	runId    string
+	entityId string
+	count    int
+	waiters  []waiter
+	timer    *time.Timer
+}
+
+type waiter struct {
+	decrement int
+	done      chan error
+}
+
+// New creates an aggregator writing to store once window has passed since
+// the first decrement of an entity, or as soon as maxMessages decrements
+// were collected (0 for no limit)
+func New(store Store, window time.Duration, maxMessages int) *Aggregator {
+	return &Aggregator{
+		store:       store,
+		window:      window,
+		maxMessages: maxMessages,
+		pending:     make(map[string]*batch),
+	}
+}
+
+// DecrementMessageCount adds the decrement to the pending batch of the entity
+// and waits for the batch to be written. The wait outlives ctx, as the write
+// may still apply the decrement after ctx is done.
+func (a *Aggregator) DecrementMessageCount(ctx context.Context, runId string, entityId string, decrementCount int) error {
+	done := make(chan error, 1)
+
+	a.mu.Lock()
+	b, ok := a.pending[runId+"#"+entityId]
+	if !ok {
+		b = &batch{runId: runId, entityId: entityId}
+		a.pending[runId+"#"+entityId] = b
+		b.timer = time.AfterFunc(a.window, func() { a.flush(b) })
+	}
+	b.count += decrementCount
+	b.waiters = append(b.waiters, waiter{decrement: decrementCount, done: done})
+	full := a.maxMessages > 0 && len(b.waiters) >= a.maxMessages
+	a.mu.Unlock()
+
+	if full {
+		a.flush(b)
+	}
+
+	return <-done
+}
+
+// flush writes the batch unless it was already flushed
+func (a *Aggregator) flush(b *batch) {
+	a.mu.Lock()
+	key := b.runId + "#" + b.entityId
+	if a.pending[key] != b {
+		a.mu.Unlock()
+		return
+	}
+	delete(a.pending, key)
+	b.timer.Stop()
+	a.mu.Unlock()
+
+	ctx := context.Background()
+
+	a.writes.Add(1)
+	err := a.store.DecrementMessageCount(ctx, b.runId, b.entityId, b.count)
+
+	var underflow *dynamodb.UnderflowError
+	if !errors.As(err, &underflow) || len(b.waiters) == 1 {
+		if err == nil {
+			a.decrements.Add(int64(len(b.waiters)))
+		}
+		for _, w := range b.waiters {
+			w.done <- err
+		}
+		return
+	}
+
+	// The batch holds more decrements than the entity has messages left,
+	// so some of them are duplicates. Count down what is left and report
+	// the excess decrements as underflows.
+	applied := 0
+	if underflow.MessageCount > 0 {
+		a.writes.Add(1)
+		if err := a.store.DecrementMessageCount(ctx, b.runId, b.entityId, underflow.MessageCount); err != nil {
+			for _, w := range b.waiters {
+				w.done <- err
+			}
+			return
+		}
+		applied = underflow.MessageCount
+	}
+
+	for _, w := range b.waiters {
+		if w.decrement <= applied {
+			applied -= w.decrement
+			a.decrements.Add(1)
+			w.done <- nil
+			continue
+		}
+		w.done <- &dynamodb.UnderflowError{EntityId: b.entityId, MessageCount: applied, Decrement: w.decrement}
+	}
+}
+
+// String summarizes how many decrements were coalesced into how many writes
+func (a *Aggregator) String() string {
+	return fmt.Sprintf("decrements=%d writes=%d", a.decrements.Load(), a.writes.Load())
+}
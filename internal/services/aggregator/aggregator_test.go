@@ -0,0 +1,186 @@
+package aggregator
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	dynamodb "github.com/debojitroy/aws-queue-tasks-consume/internal/services/aws/dynamodb"
+)
+
+// fakeStore keeps message counts in memory and fails decrements the way
+// the DynamoDB client does
+type fakeStore struct {
+	mu     sync.Mutex
+	counts map[string]int
+	writes []int
+}
+
+func newFakeStore(entityId string, count int) *fakeStore {
+	return &fakeStore{counts: map[string]int{"run#" + entityId: count}}
+}
+
+func (f *fakeStore) DecrementMessageCount(ctx context.Context, runId string, entityId string, decrementCount int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.writes = append(f.writes, decrementCount)
+
+	count, ok := f.counts[runId+"#"+entityId]
+	if !ok {
+		return &dynamodb.NotFoundError{RunId: runId, EntityId: entityId}
+	}
+	if count < decrementCount {
+		return &dynamodb.UnderflowError{EntityId: entityId, MessageCount: count, Decrement: decrementCount}
+	}
+	f.counts[runId+"#"+entityId] = count - decrementCount
+	return nil
+}
+
+func (f *fakeStore) count(entityId string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.counts["run#"+entityId]
+}
+
+func (f *fakeStore) writesMade() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.writes)
+}
+
+// decrementConcurrently decrements the entity once per caller and returns
+// the error each caller got
+func decrementConcurrently(a *Aggregator, entityId string, callers int) []error {
+	errs := make([]error, callers)
+
+	var wg sync.WaitGroup
+	for i := range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = a.DecrementMessageCount(context.Background(), "run", entityId, 1)
+		}()
+	}
+	wg.Wait()
+
+	return errs
+}
+
+func TestSingleWaiter(t *testing.T) {
+	store := newFakeStore("entity", 5)
+	a := New(store, 10*time.Millisecond, 10)
+
+	if err := a.DecrementMessageCount(context.Background(), "run", "entity", 1); err != nil {
+		t.Fatalf("DecrementMessageCount: %v", err)
+	}
+
+	if writes := store.writesMade(); !slices.Equal(writes, []int{1}) {
+		t.Fatalf("writes = %v, want [1]", writes)
+	}
+	if count := store.count("entity"); count != 4 {
+		t.Fatalf("count = %d, want 4", count)
+	}
+}
+
+func TestCoalescesWaiters(t *testing.T) {
+	const callers = 5
+	store := newFakeStore("entity", 10)
+	// The batch is flushed once full, long before the window passes
+	a := New(store, time.Hour, callers)
+
+	for i, err := range decrementConcurrently(a, "entity", callers) {
+		if err != nil {
+			t.Fatalf("caller %d: %v", i, err)
+		}
+	}
+
+	if writes := store.writesMade(); !slices.Equal(writes, []int{callers}) {
+		t.Fatalf("writes = %v, want [%d]", writes, callers)
+	}
+	if count := store.count("entity"); count != 10-callers {
+		t.Fatalf("count = %d, want %d", count, 10-callers)
+	}
+	if got, want := a.String(), "decrements=5 writes=1"; got != want {
+		t.Fatalf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestFlushesWhenWindowPasses(t *testing.T) {
+	const window = 50 * time.Millisecond
+	store := newFakeStore("entity", 5)
+	a := New(store, window, 0)
+
+	start := time.Now()
+	if err := a.DecrementMessageCount(context.Background(), "run", "entity", 1); err != nil {
+		t.Fatalf("DecrementMessageCount: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed < window {
+		t.Fatalf("DecrementMessageCount returned after %v, before the window of %v passed", elapsed, window)
+	}
+	if writes := store.writesMade(); !slices.Equal(writes, []int{1}) {
+		t.Fatalf("writes = %v, want [1]", writes)
+	}
+}
+
+func TestPartialUnderflow(t *testing.T) {
+	store := newFakeStore("entity", 2)
+	a := New(store, time.Hour, 3)
+
+	var succeeded, underflowed int
+	for i, err := range decrementConcurrently(a, "entity", 3) {
+		var underflow *dynamodb.UnderflowError
+		switch {
+		case err == nil:
+			succeeded++
+		case errors.As(err, &underflow):
+			underflowed++
+		default:
+			t.Fatalf("caller %d: %v", i, err)
+		}
+	}
+
+	if succeeded != 2 || underflowed != 1 {
+		t.Fatalf("%d succeeded and %d underflowed, want 2 and 1", succeeded, underflowed)
+	}
+	// The coalesced write fails and what is left is counted down instead
+	if writes := store.writesMade(); !slices.Equal(writes, []int{3, 2}) {
+		t.Fatalf("writes = %v, want [3 2]", writes)
+	}
+	if count := store.count("entity"); count != 0 {
+		t.Fatalf("count = %d, want 0", count)
+	}
+}
+
+func TestUnderflowWithNothingLeft(t *testing.T) {
+	store := newFakeStore("entity", 0)
+	a := New(store, time.Hour, 2)
+
+	for i, err := range decrementConcurrently(a, "entity", 2) {
+		var underflow *dynamodb.UnderflowError
+		if !errors.As(err, &underflow) {
+			t.Fatalf("caller %d: error = %v, want an UnderflowError", i, err)
+		}
+	}
+
+	// Nothing is left to count down, so there is no second write
+	if writes := store.writesMade(); !slices.Equal(writes, []int{2}) {
+		t.Fatalf("writes = %v, want [2]", writes)
+	}
+}
+
+func TestErrorsReachEveryWaiter(t *testing.T) {
+	store := newFakeStore("entity", 5)
+	a := New(store, time.Hour, 2)
+
+	for i, err := range decrementConcurrently(a, "missing", 2) {
+		var notFound *dynamodb.NotFoundError
+		if !errors.As(err, &notFound) {
+			t.Fatalf("caller %d: error = %v, want a NotFoundError", i, err)
+		}
+	}
+}
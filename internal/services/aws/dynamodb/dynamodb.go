@@ -2,27 +2,62 @@ package dynamodb
 
 import (
 	"context"
+	"errors"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	tracing "github.com/debojitroy/aws-queue-tasks-consume/internal/services/tracing"
 	color "github.com/fatih/color"
 )
 
 var cErr = color.New(color.FgRed).Add(color.Bold)
 
+// EntityMessages is the item of an entity. Items are keyed by run_id and
+// entity_id, so that the entities of many runs share the table.
 type EntityMessages struct {
+	RunId        string `dynamodbav:"run_id"`
 	EntityId     string `dynamodbav:"entity_id"`
 	MessageCount int    `dynamodbav:"message_count"`
+	// TraceParent links stream records of the item back to the producer run
+	TraceParent string `dynamodbav:"trace_parent,omitempty"`
+
+	// Lifecycle of the entity, timestamps are RFC 3339 in UTC
+	Status           Status `dynamodbav:"status,omitempty"`
+	CreatedAt        string `dynamodbav:"created_at,omitempty"`
+	FirstProcessedAt string `dynamodbav:"first_processed_at,omitempty"`
+	CompletedAt      string `dynamodbav:"completed_at,omitempty"`
+	LastUpdated      string `dynamodbav:"last_updated,omitempty"`
+	// DeliverBy is when the last delayed message of the entity becomes
+	// deliverable, empty when its messages are not delayed
+	DeliverBy string `dynamodbav:"deliver_by,omitempty"`
+
+	// ExpiresAt is the TTL attribute, in seconds since the epoch, after
+	// which DynamoDB deletes the item
+	ExpiresAt int64 `dynamodbav:"expires_at,omitempty"`
+}
+
+// entityKey returns the primary key of the entity item
+func entityKey(runId string, entityId string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"run_id":    &types.AttributeValueMemberS{Value: runId},
+		"entity_id": &types.AttributeValueMemberS{Value: entityId},
+	}
 }
 
 // DynamoDBClient wraps the DynamoDB client and table name
 type DynamoDBClient struct {
 	client    *dynamodb.Client
 	tableName string
+
+	// finishedRetention is how long items are kept once they reach a
+	// terminal state, zero to leave expires_at as it is
+	finishedRetention time.Duration
 }
 
 // NewDynamoDBClient creates a new DynamoDB client
@@ -35,6 +70,9 @@ func NewDynamoDBClient(region string, tableName string) (*DynamoDBClient, error)
 		return nil, err
 	}
 
+	// Trace every AWS call made with the config
+	tracing.InstrumentAWS(&cfg)
+
 	// Create DynamoDB client
 	client := dynamodb.NewFromConfig(cfg)
 
@@ -44,8 +82,23 @@ func NewDynamoDBClient(region string, tableName string) (*DynamoDBClient, error)
 	}, nil
 }
 
-// PutMessageCount adds the number of messages to DynamoDB
+// ExpireFinishedAfter makes items expire the given duration after they
+// reached a terminal state, if that is earlier than their current expiry.
+// Items without an expiry are kept.
+func (d *DynamoDBClient) ExpireFinishedAfter(retention time.Duration) {
+	d.finishedRetention = retention
+}
+
+// PutMessageCount adds the number of messages to DynamoDB. Items without a
+// status are stored as queued.
 func (d *DynamoDBClient) PutMessageCount(ctx context.Context, item EntityMessages) error {
+	if item.Status == "" {
+		now := timestamp(time.Now())
+		item.Status = StatusQueued
+		item.CreatedAt = now
+		item.LastUpdated = now
+	}
+
 	// Marshal the Go struct into a DynamoDB attribute value map
 	av, err := attributevalue.MarshalMap(item)
 	if err != nil {
@@ -67,28 +120,82 @@ func (d *DynamoDBClient) PutMessageCount(ctx context.Context, item EntityMessage
 	return nil
 }
 
-// DecrementMessageCount decrements the number of messages in DynamoDB
-func (d *DynamoDBClient) DecrementMessageCount(ctx context.Context, entityId string, decrementCount int) error {
+// decrementExpression returns the update and condition that decrement the
+// message count of an existing entity, without going below zero, and move it
+// into progress
+func (d *DynamoDBClient) decrementExpression(decrementCount int, now time.Time) (update string, condition string, names map[string]string, values map[string]types.AttributeValue) {
+	set, condition, names, values := d.transitionExpression(StatusInProgress, now)
+
+	names["#count"] = "message_count"
+	values[":decrement"] = &types.AttributeValueMemberN{Value: strconv.Itoa(decrementCount)}
+
+	update = "SET #count = #count - :decrement, " + strings.Join(set, ", ")
+	condition = "#count >= :decrement AND " + condition
+	return update, condition, names, values
+}
+
+// DecrementMessageCount decrements the number of messages in DynamoDB and
+// marks the entity in progress. It fails with a NotFoundError if the entity
+// has no item, with an UnderflowError if the count would go below zero and
+// with a TransitionError if the entity is no longer processed.
+func (d *DynamoDBClient) DecrementMessageCount(ctx context.Context, runId string, entityId string, decrementCount int) error {
+	update, condition, names, values := d.decrementExpression(decrementCount, time.Now())
+
 	// Create the UpdateItem input
 	input := &dynamodb.UpdateItemInput{
-		TableName: &d.tableName,
-		Key: map[string]types.AttributeValue{
-			"entity_id": &types.AttributeValueMemberS{Value: entityId},
-		},
-		UpdateExpression: aws.String("SET #count = #count - :decrement"),
+		TableName:                           &d.tableName,
+		Key:                                 entityKey(runId, entityId),
+		UpdateExpression:                    aws.String(update),
+		ConditionExpression:                 aws.String(condition),
+		ExpressionAttributeNames:            names,
+		ExpressionAttributeValues:           values,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	}
+
+	// Execute the UpdateItem operation
+	_, err := d.client.UpdateItem(ctx, input)
+	if err != nil {
+		var conditionFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionFailed) {
+			return decrementConditionError(runId, entityId, decrementCount, conditionFailed.Item)
+		}
+
+		cErr.Printf("Update Error Reason: %s \n", err.Error())
+		cErr.Printf("Update Error: %+v \n", err)
+		return err
+	}
+
+	return nil
+}
+
+// CorrectMessageCount takes messages that were never sent off the count of an
+// entity. Unlike DecrementMessageCount it leaves the lifecycle of the entity
+// alone, as no consumer has processed anything. It fails with a NotFoundError
+// if the entity has no item and with an UnderflowError if the count would go
+// below zero.
+func (d *DynamoDBClient) CorrectMessageCount(ctx context.Context, runId string, entityId string, correction int) error {
+	input := &dynamodb.UpdateItemInput{
+		TableName:        &d.tableName,
+		Key:              entityKey(runId, entityId),
+		UpdateExpression: aws.String("SET #count = #count - :correction, last_updated = :now"),
+		// Items without a count do not exist
+		ConditionExpression: aws.String("#count >= :correction"),
 		ExpressionAttributeNames: map[string]string{
 			"#count": "message_count",
 		},
 		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":decrement": &types.AttributeValueMemberN{Value: strconv.Itoa(decrementCount)},
+			":correction": &types.AttributeValueMemberN{Value: strconv.Itoa(correction)},
+			":now":        &types.AttributeValueMemberS{Value: timestamp(time.Now())},
 		},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
 	}
 
-	// Execute the UpdateItem operation
 	_, err := d.client.UpdateItem(ctx, input)
 	if err != nil {
-		cErr.Printf("Update Error Reason: %s \n", err.Error())
-		cErr.Printf("Update Error: %+v \n", err)
+		var conditionFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionFailed) {
+			return decrementConditionError(runId, entityId, correction, conditionFailed.Item)
+		}
 		return err
 	}
 
@@ -0,0 +1,50 @@
+package dynamodb
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// NotFoundError is returned when decrementing the message count of an entity
+// that has no item in the table
+type NotFoundError struct {
+	RunId    string
+	EntityId string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("entity %s of run %s not found", e.EntityId, e.RunId)
+}
+
+// UnderflowError is returned when a decrement would take the message count of
+// an entity below zero. The count is left unchanged.
+type UnderflowError struct {
+	EntityId     string
+	MessageCount int
+	Decrement    int
+}
+
+func (e *UnderflowError) Error() string {
+	return fmt.Sprintf("decrementing message count %d of entity %s by %d would go below zero",
+		e.MessageCount, e.EntityId, e.Decrement)
+}
+
+// decrementConditionError tells the condition failures of a decrement apart
+// using the item as it was when the condition was checked
+func decrementConditionError(runId string, entityId string, decrement int, item map[string]types.AttributeValue) error {
+	if len(item) == 0 {
+		return &NotFoundError{RunId: runId, EntityId: entityId}
+	}
+
+	var current EntityMessages
+	if err := attributevalue.UnmarshalMap(item, &current); err != nil {
+		return err
+	}
+
+	if current.MessageCount < decrement {
+		return &UnderflowError{EntityId: entityId, MessageCount: current.MessageCount, Decrement: decrement}
+	}
+	return &TransitionError{EntityId: entityId, From: current.Status, To: StatusInProgress}
+}
@@ -0,0 +1,138 @@
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ProcessedMessage marks a message as processed in the ledger table
+type ProcessedMessage struct {
+	MessageKey  string `dynamodbav:"message_key"`
+	RunId       string `dynamodbav:"run_id"`
+	EntityId    string `dynamodbav:"entity_id"`
+	MessageId   string `dynamodbav:"message_id"`
+	ProcessedAt string `dynamodbav:"processed_at"`
+	// ExpiresAt is the TTL attribute, in seconds since the epoch
+	ExpiresAt int64 `dynamodbav:"expires_at,omitempty"`
+}
+
+// Ledger decrements message counts exactly once per message by writing a
+// processed-marker to the ledger table in the same transaction as the
+// decrement. The ledger table is keyed by message_key.
+type Ledger struct {
+	client      *DynamoDBClient
+	ledgerTable string
+
+	// retention is how long markers are kept, zero to keep them forever
+	retention time.Duration
+}
+
+// NewLedger creates a ledger for the counters of the client's table
+func NewLedger(client *DynamoDBClient, ledgerTable string) *Ledger {
+	return &Ledger{
+		client:      client,
+		ledgerTable: ledgerTable,
+	}
+}
+
+// ExpireAfter makes processed-markers expire the given duration after the
+// message was processed
+func (l *Ledger) ExpireAfter(retention time.Duration) {
+	l.retention = retention
+}
+
+// messageKey is the key of the processed-marker of a message
+func messageKey(runId string, entityId string, messageId string) string {
+	return runId + "#" + entityId + "#" + messageId
+}
+
+// Consume inserts the processed-marker and decrements the counter
+// atomically. It returns false if the marker already exists, and the errors
+// of DecrementMessageCount if the counter cannot be decremented.
+func (l *Ledger) Consume(ctx context.Context, runId string, entityId string, messageId string) (bool, error) {
+	now := time.Now()
+
+	processed := ProcessedMessage{
+		MessageKey:  messageKey(runId, entityId, messageId),
+		RunId:       runId,
+		EntityId:    entityId,
+		MessageId:   messageId,
+		ProcessedAt: now.UTC().Format(time.RFC3339),
+	}
+	if l.retention > 0 {
+		processed.ExpiresAt = now.Add(l.retention).Unix()
+	}
+
+	marker, err := attributevalue.MarshalMap(processed)
+	if err != nil {
+		return false, err
+	}
+
+	update, condition, names, values := l.client.decrementExpression(1, now)
+
+	input := &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{
+				Put: &types.Put{
+					TableName:           &l.ledgerTable,
+					Item:                marker,
+					ConditionExpression: aws.String("attribute_not_exists(message_key)"),
+				},
+			},
+			{
+				Update: &types.Update{
+					TableName:                           &l.client.tableName,
+					Key:                                 entityKey(runId, entityId),
+					UpdateExpression:                    aws.String(update),
+					ConditionExpression:                 aws.String(condition),
+					ExpressionAttributeNames:            names,
+					ExpressionAttributeValues:           values,
+					ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+				},
+			},
+		},
+	}
+
+	_, err = l.client.client.TransactWriteItems(ctx, input)
+	if err != nil {
+		var canceled *types.TransactionCanceledException
+		if errors.As(err, &canceled) && len(canceled.CancellationReasons) == 2 {
+			marker, counter := canceled.CancellationReasons[0], canceled.CancellationReasons[1]
+
+			// The marker already exists when the first item failed its condition
+			if aws.ToString(marker.Code) == "ConditionalCheckFailed" {
+				return false, nil
+			}
+			if aws.ToString(counter.Code) == "ConditionalCheckFailed" {
+				return false, decrementConditionError(runId, entityId, 1, counter.Item)
+			}
+		}
+
+		cErr.Printf("Ledger Error Reason: %s \n", err.Error())
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Processed reports whether the processed-marker of the message exists
+func (l *Ledger) Processed(ctx context.Context, runId string, entityId string, messageId string) (bool, error) {
+	output, err := l.client.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: &l.ledgerTable,
+		Key: map[string]types.AttributeValue{
+			"message_key": &types.AttributeValueMemberS{Value: messageKey(runId, entityId, messageId)},
+		},
+		ProjectionExpression: aws.String("message_key"),
+		ConsistentRead:       aws.Bool(true),
+	})
+	if err != nil {
+		return false, err
+	}
+	return len(output.Item) > 0, nil
+}
@@ -0,0 +1,224 @@
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Status is the lifecycle state of an entity
+type Status string
+
+const (
+	// StatusQueued entities have their messages queued, none processed yet
+	StatusQueued Status = "queued"
+	// StatusInProgress entities had at least one message processed
+	StatusInProgress Status = "in_progress"
+	// StatusCompleted entities had all their messages processed
+	StatusCompleted Status = "completed"
+	// StatusFailed entities could not be queued or processed
+	StatusFailed Status = "failed"
+	// StatusCancelled entities are no longer processed
+	StatusCancelled Status = "cancelled"
+)
+
+// StatusIndex is the global secondary index keyed by status and last_updated
+const StatusIndex = "status-index"
+
+// transitions lists the states each state may be entered from. Queued is
+// only entered when the item is written. Items written before statuses were
+// introduced may enter any state.
+var transitions = map[Status][]Status{
+	StatusInProgress: {StatusQueued, StatusInProgress},
+	StatusCompleted:  {StatusQueued, StatusInProgress},
+	StatusFailed:     {StatusQueued, StatusInProgress},
+	StatusCancelled:  {StatusQueued, StatusInProgress},
+}
+
+// TransitionError is returned when an entity cannot enter a state from the
+// state it is in
+type TransitionError struct {
+	EntityId string
+	From     Status
+	To       Status
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("entity %s cannot go from %s to %s", e.EntityId, e.From, e.To)
+}
+
+// timestamp formats the time as stored in lifecycle attributes
+func timestamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// transitionExpression returns the SET clauses, the condition and their
+// names and values that move an item into the state
+func (d *DynamoDBClient) transitionExpression(to Status, now time.Time) (set []string, condition string, names map[string]string, values map[string]types.AttributeValue) {
+	names = map[string]string{"#status": "status"}
+	values = map[string]types.AttributeValue{
+		":to":  &types.AttributeValueMemberS{Value: string(to)},
+		":now": &types.AttributeValueMemberS{Value: timestamp(now)},
+	}
+
+	set = []string{"#status = :to", "last_updated = :now"}
+	switch to {
+	case StatusInProgress:
+		set = append(set, "first_processed_at = if_not_exists(first_processed_at, :now)")
+	case StatusCompleted:
+		set = append(set, "completed_at = :now")
+	}
+
+	condition = "attribute_exists(entity_id) AND (attribute_not_exists(#status)"
+	for i, from := range transitions[to] {
+		placeholder := fmt.Sprintf(":from%d", i)
+		values[placeholder] = &types.AttributeValueMemberS{Value: string(from)}
+		condition += " OR #status = " + placeholder
+	}
+	condition += ")"
+
+	return set, condition, names, values
+}
+
+// Transition moves the entity into the state. It fails with a NotFoundError
+// if the entity has no item and with a TransitionError if the state cannot
+// be entered from the current one.
+func (d *DynamoDBClient) Transition(ctx context.Context, runId string, entityId string, to Status) error {
+	now := time.Now()
+	set, condition, names, values := d.transitionExpression(to, now)
+
+	input := &dynamodb.UpdateItemInput{
+		TableName:                           &d.tableName,
+		Key:                                 entityKey(runId, entityId),
+		UpdateExpression:                    aws.String("SET " + strings.Join(set, ", ")),
+		ConditionExpression:                 aws.String(condition),
+		ExpressionAttributeNames:            names,
+		ExpressionAttributeValues:           values,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	}
+
+	_, err := d.client.UpdateItem(ctx, input)
+	if err != nil {
+		var conditionFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionFailed) {
+			if len(conditionFailed.Item) == 0 {
+				return &NotFoundError{RunId: runId, EntityId: entityId}
+			}
+
+			var current EntityMessages
+			if err := attributevalue.UnmarshalMap(conditionFailed.Item, &current); err != nil {
+				return err
+			}
+			return &TransitionError{EntityId: entityId, From: current.Status, To: to}
+		}
+
+		cErr.Printf("Transition Error Reason: %s \n", err.Error())
+		return err
+	}
+
+	// Finished entities are only kept for a short while
+	if to.IsTerminal() && d.finishedRetention > 0 {
+		d.shortenExpiry(ctx, runId, entityId, now.Add(d.finishedRetention))
+	}
+
+	return nil
+}
+
+// shortenExpiry moves the TTL of the item forward to expiresAt. Items that
+// are kept forever, or expire before expiresAt anyway, are left alone.
+func (d *DynamoDBClient) shortenExpiry(ctx context.Context, runId string, entityId string, expiresAt time.Time) {
+	_, err := d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           &d.tableName,
+		Key:                 entityKey(runId, entityId),
+		UpdateExpression:    aws.String("SET expires_at = :expires_at"),
+		ConditionExpression: aws.String("expires_at > :expires_at"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":expires_at": &types.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt.Unix(), 10)},
+		},
+	})
+
+	var conditionFailed *types.ConditionalCheckFailedException
+	if err != nil && !errors.As(err, &conditionFailed) {
+		cErr.Printf("Failed to shorten expiry of Entity Id %s: %v \n", entityId, err)
+	}
+}
+
+// ListEntitiesByStatus returns the entities of the run in the state, least
+// recently updated first. An empty run id lists the entities of all runs.
+func (d *DynamoDBClient) ListEntitiesByStatus(ctx context.Context, runId string, status Status) ([]EntityMessages, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              &d.tableName,
+		IndexName:              aws.String(StatusIndex),
+		KeyConditionExpression: aws.String("#status = :status"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":status": &types.AttributeValueMemberS{Value: string(status)},
+		},
+	}
+	if runId != "" {
+		input.FilterExpression = aws.String("run_id = :run_id")
+		input.ExpressionAttributeValues[":run_id"] = &types.AttributeValueMemberS{Value: runId}
+	}
+
+	var entities []EntityMessages
+
+	paginator := dynamodb.NewQueryPaginator(d.client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var items []EntityMessages
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &items); err != nil {
+			return nil, err
+		}
+		entities = append(entities, items...)
+	}
+
+	return entities, nil
+}
+
+// ListRunEntities returns all entities of the run
+func (d *DynamoDBClient) ListRunEntities(ctx context.Context, runId string) ([]EntityMessages, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              &d.tableName,
+		KeyConditionExpression: aws.String("run_id = :run_id"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":run_id": &types.AttributeValueMemberS{Value: runId},
+		},
+	}
+
+	var entities []EntityMessages
+
+	paginator := dynamodb.NewQueryPaginator(d.client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var items []EntityMessages
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &items); err != nil {
+			return nil, err
+		}
+		entities = append(entities, items...)
+	}
+
+	return entities, nil
+}
+
+// IsTerminal reports whether no further transitions are possible
+func (s Status) IsTerminal() bool {
+	return s == StatusCompleted || s == StatusFailed || s == StatusCancelled
+}
@@ -2,17 +2,14 @@ package kinesis
 
 import (
 	"context"
-	"log"
-	"os"
-	"os/signal"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/kinesis"
 	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	tracing "github.com/debojitroy/aws-queue-tasks-consume/internal/services/tracing"
 	color "github.com/fatih/color"
 )
 
@@ -38,14 +35,12 @@ func NewKinesisConsumer(streamName string, region string) (*KinesisConsumer, err
 		return nil, err
 	}
 
-	// Create context with cancellation
-	ctx, cancel := context.WithCancel(context.Background())
+	// Trace every AWS call made with the config
+	tracing.InstrumentAWS(&cfg)
 
 	return &KinesisConsumer{
 		client:     kinesis.NewFromConfig(cfg),
 		streamName: streamName,
-		ctx:        ctx,
-		cancel:     cancel,
 	}, nil
 }
 
@@ -127,8 +122,11 @@ func (kc *KinesisConsumer) processShard(shardId string, handler KinesisRecordHan
 			})
 
 			if err != nil {
+				if kc.ctx.Err() != nil {
+					continue
+				}
 				cErr.Printf("Error getting records from shard %s: %+v \n", shardId, err)
-				time.Sleep(time.Second) // Basic retry mechanism
+				kc.sleep(time.Second) // Basic retry mechanism
 				continue
 			}
 
@@ -149,12 +147,30 @@ func (kc *KinesisConsumer) processShard(shardId string, handler KinesisRecordHan
 			}
 
 			// Add a small delay to avoid hitting API limits
-			time.Sleep(time.Second)
+			kc.sleep(time.Second)
 		}
 	}
 }
 
-func (kc *KinesisConsumer) Start(handler KinesisRecordHandler) error {
+// sleep waits for the given duration or until the consumer is stopped
+func (kc *KinesisConsumer) sleep(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-kc.ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// Run processes all shards of the stream until the context is cancelled or
+// every shard is closed
+func (kc *KinesisConsumer) Run(ctx context.Context, handler KinesisRecordHandler) error {
+	kc.ctx, kc.cancel = context.WithCancel(ctx)
+	defer kc.cancel()
+
+	c.Printf("Starting to consume from stream: %s \n", kc.streamName)
+
 	// Get all shard IDs
 	shardIds, err := kc.getShardIds()
 	if err != nil {
@@ -171,30 +187,6 @@ func (kc *KinesisConsumer) Start(handler KinesisRecordHandler) error {
 
 	// Wait for all goroutines to complete
 	kc.wg.Wait()
+	c.Println("Consumer stopped")
 	return nil
 }
-
-func (kc *KinesisConsumer) Stop() {
-	kc.cancel()
-	kc.wg.Wait()
-	log.Println("Consumer stopped")
-}
-
-func (consumer *KinesisConsumer) StartKinesisStreamProcessor(handler KinesisRecordHandler) {
-	// Handle graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-
-	// Start consumer in a goroutine
-	go func() {
-		c.Printf("Starting to consume from stream: %s \n", consumer.streamName)
-		if err := consumer.Start(handler); err != nil {
-			log.Fatalf("Error starting consumer: %v", err)
-		}
-	}()
-
-	// Wait for shutdown signal
-	<-sigChan
-	c.Println("Shutting down...")
-	consumer.Stop()
-}
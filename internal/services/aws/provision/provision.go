@@ -0,0 +1,537 @@
+package provision
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	kinesistypes "github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	entitydb "github.com/debojitroy/aws-queue-tasks-consume/internal/services/aws/dynamodb"
+	color "github.com/fatih/color"
+)
+
+var c = color.New(color.FgHiMagenta)
+
+// maxWait bounds how long to wait for tables and streams to become active
+const maxWait = 5 * time.Minute
+
+// Config names the resources used by the application
+type Config struct {
+	Region string
+	// Endpoint overrides the AWS endpoint, e.g. for LocalStack
+	Endpoint string
+
+	QueueName string
+	// DeadLetterQueueName receives messages failing MaxReceiveCount times
+	DeadLetterQueueName string
+	MaxReceiveCount     int
+	VisibilityTimeout   int
+
+	TableName string
+	// LedgerTableName is optional, see dynamodb.Ledger
+	LedgerTableName string
+
+	StreamName string
+	ShardCount int32
+}
+
+// Resources are the identifiers of the provisioned resources
+type Resources struct {
+	QueueURL           string
+	DeadLetterQueueURL string
+	TableArn           string
+	StreamArn          string
+}
+
+// Provisioner creates and deletes the resources of the application
+type Provisioner struct {
+	cfg     Config
+	sqs     *sqs.Client
+	ddb     *dynamodb.Client
+	kinesis *kinesis.Client
+}
+
+// NewProvisioner creates a provisioner for the configured resources
+func NewProvisioner(cfg Config) (*Provisioner, error) {
+	if cfg.QueueName == "" || cfg.DeadLetterQueueName == "" || cfg.TableName == "" || cfg.StreamName == "" {
+		return nil, fmt.Errorf("queue, dead-letter queue, table and stream names are required")
+	}
+	if IsFifo(cfg.QueueName) != IsFifo(cfg.DeadLetterQueueName) {
+		return nil, fmt.Errorf("queue and dead-letter queue must both be FIFO or both be standard queues")
+	}
+
+	// Load AWS configuration
+	opts := []func(*config.LoadOptions) error{config.WithRegion(cfg.Region)}
+	if cfg.Endpoint != "" {
+		opts = append(opts, config.WithBaseEndpoint(cfg.Endpoint))
+	}
+	awsCfg, err := config.LoadDefaultConfig(context.TODO(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Provisioner{
+		cfg:     cfg,
+		sqs:     sqs.NewFromConfig(awsCfg),
+		ddb:     dynamodb.NewFromConfig(awsCfg),
+		kinesis: kinesis.NewFromConfig(awsCfg),
+	}, nil
+}
+
+// IsFifo reports whether the queue name is the name of a FIFO queue
+func IsFifo(queueName string) bool {
+	return strings.HasSuffix(queueName, ".fifo")
+}
+
+// Bootstrap creates whatever resources are missing and brings the existing
+// ones to the expected configuration: queue attributes, missing secondary
+// indexes, TTL and streaming are updated in place, while a table with a
+// different key schema is an error. It can be run repeatedly.
+func (p *Provisioner) Bootstrap(ctx context.Context) (*Resources, error) {
+	resources := &Resources{}
+	var err error
+
+	// Queues
+	resources.DeadLetterQueueURL, err = p.createQueue(ctx, p.cfg.DeadLetterQueueName, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating dead-letter queue: %w", err)
+	}
+
+	dlqArn, err := p.queueArn(ctx, resources.DeadLetterQueueURL)
+	if err != nil {
+		return nil, err
+	}
+
+	redrivePolicy, err := json.Marshal(map[string]string{
+		"deadLetterTargetArn": dlqArn,
+		"maxReceiveCount":     strconv.Itoa(p.cfg.MaxReceiveCount),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	attributes := map[string]string{
+		string(sqstypes.QueueAttributeNameVisibilityTimeout): strconv.Itoa(p.cfg.VisibilityTimeout),
+	}
+	if p.cfg.MaxReceiveCount > 0 {
+		attributes[string(sqstypes.QueueAttributeNameRedrivePolicy)] = string(redrivePolicy)
+	}
+
+	resources.QueueURL, err = p.createQueue(ctx, p.cfg.QueueName, attributes)
+	if err != nil {
+		return nil, fmt.Errorf("creating queue: %w", err)
+	}
+
+	// Tables
+	resources.TableArn, err = p.createTable(ctx, entityTable(p.cfg.TableName))
+	if err != nil {
+		return nil, fmt.Errorf("creating table: %w", err)
+	}
+
+	if err := p.enableTTL(ctx, p.cfg.TableName, "expires_at"); err != nil {
+		return nil, fmt.Errorf("enabling TTL: %w", err)
+	}
+
+	if p.cfg.LedgerTableName != "" {
+		if _, err := p.createTable(ctx, ledgerTable(p.cfg.LedgerTableName)); err != nil {
+			return nil, fmt.Errorf("creating ledger table: %w", err)
+		}
+
+		if err := p.enableTTL(ctx, p.cfg.LedgerTableName, "expires_at"); err != nil {
+			return nil, fmt.Errorf("enabling TTL on ledger table: %w", err)
+		}
+	}
+
+	// Stream
+	resources.StreamArn, err = p.createStream(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("creating stream: %w", err)
+	}
+
+	if err := p.enableStreaming(ctx, resources.StreamArn); err != nil {
+		return nil, fmt.Errorf("enabling Kinesis streaming for table: %w", err)
+	}
+
+	return resources, nil
+}
+
+// createQueue creates the queue, or updates its attributes if it exists
+func (p *Provisioner) createQueue(ctx context.Context, name string, attributes map[string]string) (string, error) {
+	createAttributes := map[string]string{}
+	if IsFifo(name) {
+		createAttributes[string(sqstypes.QueueAttributeNameFifoQueue)] = "true"
+	}
+
+	// CreateQueue returns the URL of an existing queue with the same name
+	output, err := p.sqs.CreateQueue(ctx, &sqs.CreateQueueInput{
+		QueueName:  aws.String(name),
+		Attributes: createAttributes,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if len(attributes) > 0 {
+		_, err = p.sqs.SetQueueAttributes(ctx, &sqs.SetQueueAttributesInput{
+			QueueUrl:   output.QueueUrl,
+			Attributes: attributes,
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	c.Printf("Queue %s is ready at %s \n", name, aws.ToString(output.QueueUrl))
+	return aws.ToString(output.QueueUrl), nil
+}
+
+func (p *Provisioner) queueArn(ctx context.Context, queueURL string) (string, error) {
+	output, err := p.sqs.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(queueURL),
+		AttributeNames: []sqstypes.QueueAttributeName{sqstypes.QueueAttributeNameQueueArn},
+	})
+	if err != nil {
+		return "", err
+	}
+	return output.Attributes[string(sqstypes.QueueAttributeNameQueueArn)], nil
+}
+
+// entityTable matches the key schema of dynamodb.EntityMessages and its
+// status index
+func entityTable(name string) *dynamodb.CreateTableInput {
+	return &dynamodb.CreateTableInput{
+		TableName:   aws.String(name),
+		BillingMode: ddbtypes.BillingModePayPerRequest,
+		AttributeDefinitions: []ddbtypes.AttributeDefinition{
+			{AttributeName: aws.String("run_id"), AttributeType: ddbtypes.ScalarAttributeTypeS},
+			{AttributeName: aws.String("entity_id"), AttributeType: ddbtypes.ScalarAttributeTypeS},
+			{AttributeName: aws.String("status"), AttributeType: ddbtypes.ScalarAttributeTypeS},
+			{AttributeName: aws.String("last_updated"), AttributeType: ddbtypes.ScalarAttributeTypeS},
+		},
+		KeySchema: []ddbtypes.KeySchemaElement{
+			{AttributeName: aws.String("run_id"), KeyType: ddbtypes.KeyTypeHash},
+			{AttributeName: aws.String("entity_id"), KeyType: ddbtypes.KeyTypeRange},
+		},
+		GlobalSecondaryIndexes: []ddbtypes.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String(entitydb.StatusIndex),
+				KeySchema: []ddbtypes.KeySchemaElement{
+					{AttributeName: aws.String("status"), KeyType: ddbtypes.KeyTypeHash},
+					{AttributeName: aws.String("last_updated"), KeyType: ddbtypes.KeyTypeRange},
+				},
+				Projection: &ddbtypes.Projection{ProjectionType: ddbtypes.ProjectionTypeAll},
+			},
+		},
+	}
+}
+
+// ledgerTable matches the key schema of dynamodb.ProcessedMessage
+func ledgerTable(name string) *dynamodb.CreateTableInput {
+	return &dynamodb.CreateTableInput{
+		TableName:   aws.String(name),
+		BillingMode: ddbtypes.BillingModePayPerRequest,
+		AttributeDefinitions: []ddbtypes.AttributeDefinition{
+			{AttributeName: aws.String("message_key"), AttributeType: ddbtypes.ScalarAttributeTypeS},
+		},
+		KeySchema: []ddbtypes.KeySchemaElement{
+			{AttributeName: aws.String("message_key"), KeyType: ddbtypes.KeyTypeHash},
+		},
+	}
+}
+
+// createTable creates the table unless it exists, in which case its key
+// schema must match and missing secondary indexes are added. It returns the
+// table ARN once the table and its indexes are active.
+func (p *Provisioner) createTable(ctx context.Context, input *dynamodb.CreateTableInput) (string, error) {
+	name := aws.ToString(input.TableName)
+
+	existing, err := p.ddb.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: input.TableName})
+	var notFound *ddbtypes.ResourceNotFoundException
+	switch {
+	case err == nil:
+		if !sameKeySchema(existing.Table.KeySchema, input.KeySchema) {
+			return "", fmt.Errorf("table %s exists with a different key schema", name)
+		}
+		c.Printf("Table %s exists \n", name)
+		if err := p.addMissingIndexes(ctx, input, existing.Table); err != nil {
+			return "", err
+		}
+	case errors.As(err, &notFound):
+		if _, err := p.ddb.CreateTable(ctx, input); err != nil {
+			return "", err
+		}
+		c.Printf("Creating table %s \n", name)
+	default:
+		return "", err
+	}
+
+	return p.waitForTable(ctx, name)
+}
+
+// addMissingIndexes creates the global secondary indexes of the input that
+// the existing table lacks. Indexes that exist must have the same key schema.
+func (p *Provisioner) addMissingIndexes(ctx context.Context, input *dynamodb.CreateTableInput, table *ddbtypes.TableDescription) error {
+	name := aws.ToString(input.TableName)
+
+	existing := make(map[string][]ddbtypes.KeySchemaElement)
+	for _, index := range table.GlobalSecondaryIndexes {
+		existing[aws.ToString(index.IndexName)] = index.KeySchema
+	}
+
+	for _, index := range input.GlobalSecondaryIndexes {
+		indexName := aws.ToString(index.IndexName)
+		if keySchema, ok := existing[indexName]; ok {
+			if !sameKeySchema(keySchema, index.KeySchema) {
+				return fmt.Errorf("index %s of table %s exists with a different key schema", indexName, name)
+			}
+			continue
+		}
+
+		// A table takes one index creation at a time and only while active
+		if _, err := p.waitForTable(ctx, name); err != nil {
+			return err
+		}
+
+		_, err := p.ddb.UpdateTable(ctx, &dynamodb.UpdateTableInput{
+			TableName:            input.TableName,
+			AttributeDefinitions: input.AttributeDefinitions,
+			GlobalSecondaryIndexUpdates: []ddbtypes.GlobalSecondaryIndexUpdate{
+				{
+					Create: &ddbtypes.CreateGlobalSecondaryIndexAction{
+						IndexName:  index.IndexName,
+						KeySchema:  index.KeySchema,
+						Projection: index.Projection,
+					},
+				},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("adding index %s to table %s: %w", indexName, name, err)
+		}
+		c.Printf("Adding index %s to table %s \n", indexName, name)
+	}
+
+	return nil
+}
+
+// waitForTable waits until the table and all its indexes are active and
+// returns the table ARN
+func (p *Provisioner) waitForTable(ctx context.Context, name string) (string, error) {
+	waiter := dynamodb.NewTableExistsWaiter(p.ddb, func(o *dynamodb.TableExistsWaiterOptions) {
+		o.Retryable = tableActive
+	})
+	output, err := waiter.WaitForOutput(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(name)}, maxWait)
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(output.Table.TableArn), nil
+}
+
+// tableActive makes the table waiter retry until the table and its indexes,
+// which are backfilled after the table turns active, are active
+func tableActive(ctx context.Context, input *dynamodb.DescribeTableInput, output *dynamodb.DescribeTableOutput, err error) (bool, error) {
+	var notFound *ddbtypes.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if output.Table.TableStatus != ddbtypes.TableStatusActive {
+		return true, nil
+	}
+	for _, index := range output.Table.GlobalSecondaryIndexes {
+		if index.IndexStatus != ddbtypes.IndexStatusActive {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func sameKeySchema(a []ddbtypes.KeySchemaElement, b []ddbtypes.KeySchemaElement) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if aws.ToString(a[i].AttributeName) != aws.ToString(b[i].AttributeName) || a[i].KeyType != b[i].KeyType {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *Provisioner) enableTTL(ctx context.Context, table string, attribute string) error {
+	output, err := p.ddb.DescribeTimeToLive(ctx, &dynamodb.DescribeTimeToLiveInput{TableName: aws.String(table)})
+	if err != nil {
+		return err
+	}
+
+	if ttl := output.TimeToLiveDescription; ttl != nil && aws.ToString(ttl.AttributeName) == attribute &&
+		(ttl.TimeToLiveStatus == ddbtypes.TimeToLiveStatusEnabled || ttl.TimeToLiveStatus == ddbtypes.TimeToLiveStatusEnabling) {
+		return nil
+	}
+
+	_, err = p.ddb.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(table),
+		TimeToLiveSpecification: &ddbtypes.TimeToLiveSpecification{
+			AttributeName: aws.String(attribute),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	c.Printf("Enabled TTL on %s.%s \n", table, attribute)
+	return nil
+}
+
+// createStream creates the stream unless it exists and returns its ARN once
+// it is active
+func (p *Provisioner) createStream(ctx context.Context) (string, error) {
+	name := aws.String(p.cfg.StreamName)
+
+	_, err := p.kinesis.DescribeStreamSummary(ctx, &kinesis.DescribeStreamSummaryInput{StreamName: name})
+	var notFound *kinesistypes.ResourceNotFoundException
+	switch {
+	case err == nil:
+		c.Printf("Stream %s exists \n", p.cfg.StreamName)
+	case errors.As(err, &notFound):
+		_, err := p.kinesis.CreateStream(ctx, &kinesis.CreateStreamInput{
+			StreamName: name,
+			ShardCount: aws.Int32(p.cfg.ShardCount),
+		})
+		if err != nil {
+			return "", err
+		}
+		c.Printf("Creating stream %s \n", p.cfg.StreamName)
+	default:
+		return "", err
+	}
+
+	waiter := kinesis.NewStreamExistsWaiter(p.kinesis)
+	output, err := waiter.WaitForOutput(ctx, &kinesis.DescribeStreamInput{StreamName: name}, maxWait)
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(output.StreamDescription.StreamARN), nil
+}
+
+// enableStreaming sends the changes of the table to the stream
+func (p *Provisioner) enableStreaming(ctx context.Context, streamArn string) error {
+	output, err := p.ddb.DescribeKinesisStreamingDestination(ctx, &dynamodb.DescribeKinesisStreamingDestinationInput{
+		TableName: aws.String(p.cfg.TableName),
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, destination := range output.KinesisDataStreamDestinations {
+		if aws.ToString(destination.StreamArn) != streamArn {
+			continue
+		}
+		if destination.DestinationStatus == ddbtypes.DestinationStatusActive ||
+			destination.DestinationStatus == ddbtypes.DestinationStatusEnabling {
+			c.Printf("Table %s already streams to %s \n", p.cfg.TableName, p.cfg.StreamName)
+			return nil
+		}
+	}
+
+	_, err = p.ddb.EnableKinesisStreamingDestination(ctx, &dynamodb.EnableKinesisStreamingDestinationInput{
+		TableName: aws.String(p.cfg.TableName),
+		StreamArn: aws.String(streamArn),
+	})
+	if err != nil {
+		return err
+	}
+
+	c.Printf("Table %s streams to %s \n", p.cfg.TableName, p.cfg.StreamName)
+	return nil
+}
+
+// Teardown deletes all resources created by Bootstrap. Resources that do not
+// exist are skipped.
+func (p *Provisioner) Teardown(ctx context.Context) error {
+	var errs []error
+
+	if err := p.deleteStream(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("deleting stream: %w", err))
+	}
+
+	for _, table := range []string{p.cfg.TableName, p.cfg.LedgerTableName} {
+		if table == "" {
+			continue
+		}
+		if err := p.deleteTable(ctx, table); err != nil {
+			errs = append(errs, fmt.Errorf("deleting table %s: %w", table, err))
+		}
+	}
+
+	for _, queue := range []string{p.cfg.QueueName, p.cfg.DeadLetterQueueName} {
+		if err := p.deleteQueue(ctx, queue); err != nil {
+			errs = append(errs, fmt.Errorf("deleting queue %s: %w", queue, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (p *Provisioner) deleteStream(ctx context.Context) error {
+	_, err := p.kinesis.DeleteStream(ctx, &kinesis.DeleteStreamInput{
+		StreamName:              aws.String(p.cfg.StreamName),
+		EnforceConsumerDeletion: aws.Bool(true),
+	})
+	var notFound *kinesistypes.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		return nil
+	}
+	if err == nil {
+		c.Printf("Deleted stream %s \n", p.cfg.StreamName)
+	}
+	return err
+}
+
+func (p *Provisioner) deleteTable(ctx context.Context, table string) error {
+	_, err := p.ddb.DeleteTable(ctx, &dynamodb.DeleteTableInput{TableName: aws.String(table)})
+	var notFound *ddbtypes.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	c.Printf("Deleting table %s \n", table)
+	waiter := dynamodb.NewTableNotExistsWaiter(p.ddb)
+	return waiter.Wait(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(table)}, maxWait)
+}
+
+func (p *Provisioner) deleteQueue(ctx context.Context, name string) error {
+	output, err := p.sqs.GetQueueUrl(ctx, &sqs.GetQueueUrlInput{QueueName: aws.String(name)})
+	var notFound *sqstypes.QueueDoesNotExist
+	if errors.As(err, &notFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := p.sqs.DeleteQueue(ctx, &sqs.DeleteQueueInput{QueueUrl: output.QueueUrl}); err != nil {
+		return err
+	}
+
+	c.Printf("Deleted queue %s \n", name)
+	return nil
+}
@@ -0,0 +1,167 @@
+package sqs
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// SQS accepts at most 10 entries per DeleteMessageBatch call
+const maxDeleteBatchSize = 10
+
+const (
+	defaultDeleteFlushInterval = time.Second
+	defaultDeleteRetries       = 3
+)
+
+// acknowledger collects the receipt handles of successfully processed
+// messages and deletes them with DeleteMessageBatch, flushing whenever a
+// full batch is collected or the flush interval elapses.
+type acknowledger struct {
+	sqs           *sqs.Client
+	queueURL      string
+	flushInterval time.Duration
+	maxRetries    int
+
+	requests chan ackRequest
+	done     chan struct{}
+}
+
+// ackRequest is a message to delete, with an optional callback run once
+// the delete succeeded
+type ackRequest struct {
+	handle    string
+	onDeleted func()
+}
+
+func newAcknowledger(client *sqs.Client, queueURL string, flushInterval time.Duration, maxRetries int) *acknowledger {
+	if flushInterval <= 0 {
+		flushInterval = defaultDeleteFlushInterval
+	}
+	if maxRetries <= 0 {
+		maxRetries = defaultDeleteRetries
+	}
+
+	return &acknowledger{
+		sqs:           client,
+		queueURL:      queueURL,
+		flushInterval: flushInterval,
+		maxRetries:    maxRetries,
+		requests:      make(chan ackRequest, maxDeleteBatchSize),
+		done:          make(chan struct{}),
+	}
+}
+
+func (a *acknowledger) start() {
+	go a.run()
+}
+
+// ack schedules the message for deletion
+func (a *acknowledger) ack(msg *types.Message) {
+	a.requests <- ackRequest{handle: *msg.ReceiptHandle}
+}
+
+// ackThen schedules the message for deletion and calls onDeleted once the
+// message is deleted
+func (a *acknowledger) ackThen(msg *types.Message, onDeleted func()) {
+	a.requests <- ackRequest{handle: *msg.ReceiptHandle, onDeleted: onDeleted}
+}
+
+// stop flushes any pending deletes and waits for the acknowledger to exit.
+// ack must not be called after stop.
+func (a *acknowledger) stop() {
+	close(a.requests)
+	<-a.done
+}
+
+func (a *acknowledger) run() {
+	defer close(a.done)
+
+	ticker := time.NewTicker(a.flushInterval)
+	defer ticker.Stop()
+
+	var pending []ackRequest
+
+	for {
+		select {
+		case request, ok := <-a.requests:
+			if !ok {
+				a.flush(pending)
+				return
+			}
+
+			pending = append(pending, request)
+			if len(pending) >= maxDeleteBatchSize {
+				a.flush(pending)
+				pending = nil
+			}
+		case <-ticker.C:
+			if len(pending) > 0 {
+				a.flush(pending)
+				pending = nil
+			}
+		}
+	}
+}
+
+// flush deletes the given messages, retrying the entries SQS reports as
+// failed unless the failure is the caller's fault.
+func (a *acknowledger) flush(requests []ackRequest) {
+	// Deletes must complete even while the worker is shutting down
+	ctx := context.Background()
+
+	for attempt := 0; len(requests) > 0; attempt++ {
+		if attempt > 0 {
+			if attempt > a.maxRetries {
+				cErr.Printf("Giving up deleting %d messages after %d retries \n", len(requests), a.maxRetries)
+				return
+			}
+			time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+		}
+
+		entries := make([]types.DeleteMessageBatchRequestEntry, len(requests))
+		for i := range requests {
+			entries[i] = types.DeleteMessageBatchRequestEntry{
+				Id:            aws.String(strconv.Itoa(i)),
+				ReceiptHandle: aws.String(requests[i].handle),
+			}
+		}
+
+		output, err := a.sqs.DeleteMessageBatch(ctx, &sqs.DeleteMessageBatchInput{
+			QueueUrl: &a.queueURL,
+			Entries:  entries,
+		})
+		if err != nil {
+			cErr.Printf("Error deleting message batch: %v \n", err)
+			continue
+		}
+
+		var retry []ackRequest
+		failed := make(map[int]struct{}, len(output.Failed))
+		for _, failure := range output.Failed {
+			i, err := strconv.Atoi(*failure.Id)
+			if err != nil || i >= len(requests) {
+				continue
+			}
+			failed[i] = struct{}{}
+
+			cErr.Printf("Failed to delete message, Code: %s, Message: %s \n", aws.ToString(failure.Code), aws.ToString(failure.Message))
+
+			// Sender faults (e.g. an expired receipt handle) will not succeed on retry
+			if !failure.SenderFault {
+				retry = append(retry, requests[i])
+			}
+		}
+
+		for i, request := range requests {
+			if _, ok := failed[i]; !ok && request.onDeleted != nil {
+				request.onDeleted()
+			}
+		}
+		requests = retry
+	}
+}
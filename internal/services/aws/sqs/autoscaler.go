@@ -0,0 +1,133 @@
+package sqs
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+const (
+	defaultAutoscaleInterval = 30 * time.Second
+	defaultAutoscaleCooldown = time.Minute
+	defaultMessagesPerWorker = 100
+)
+
+// AutoscaleConfig bounds and paces the autoscaler
+type AutoscaleConfig struct {
+	// MinWorkers may be zero, in which case no worker long-polls an empty queue
+	MinWorkers int
+	MaxWorkers int
+	// MessagesPerWorker is the queue depth a single worker is expected to drain.
+	// Defaults to 100.
+	MessagesPerWorker int
+	// Interval between queue depth checks. Defaults to 30 seconds.
+	Interval time.Duration
+	// Cooldown is the minimum time between two resizes. Defaults to one minute.
+	Cooldown time.Duration
+}
+
+func (a *AutoscaleConfig) validate() error {
+	if a.MinWorkers < 0 {
+		return fmt.Errorf("autoscale min workers must not be negative")
+	}
+	if a.MaxWorkers < 1 || a.MaxWorkers < a.MinWorkers {
+		return fmt.Errorf("autoscale max workers must be at least 1 and not less than min workers")
+	}
+	return nil
+}
+
+func (a *AutoscaleConfig) clamp(n int) int {
+	return min(max(n, a.MinWorkers), a.MaxWorkers)
+}
+
+// desiredWorkers returns the pool size needed for the given queue depth
+func (a *AutoscaleConfig) desiredWorkers(depth int) int {
+	perWorker := a.MessagesPerWorker
+	if perWorker <= 0 {
+		perWorker = defaultMessagesPerWorker
+	}
+	return a.clamp((depth + perWorker - 1) / perWorker)
+}
+
+// queueDepth returns the number of visible and in-flight messages across
+// all polled queues
+func (w *Worker) queueDepth(ctx context.Context) (int, error) {
+	depth := 0
+
+	for _, q := range w.queues {
+		output, err := w.Sqs.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+			QueueUrl: &q.URL,
+			AttributeNames: []types.QueueAttributeName{
+				types.QueueAttributeNameApproximateNumberOfMessages,
+				types.QueueAttributeNameApproximateNumberOfMessagesNotVisible,
+			},
+		})
+		if err != nil {
+			return 0, err
+		}
+
+		for _, name := range []types.QueueAttributeName{
+			types.QueueAttributeNameApproximateNumberOfMessages,
+			types.QueueAttributeNameApproximateNumberOfMessagesNotVisible,
+		} {
+			count, err := strconv.Atoi(output.Attributes[string(name)])
+			if err != nil {
+				return 0, fmt.Errorf("invalid %s attribute of %s: %v", name, q.URL, err)
+			}
+			depth += count
+		}
+	}
+
+	return depth, nil
+}
+
+// autoscale periodically resizes the poller pool to match the queue depth
+func (w *Worker) autoscale(ctx context.Context) {
+	defer w.pollers.Done()
+
+	cfg := w.Config.Autoscale
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = defaultAutoscaleInterval
+	}
+	cooldown := cfg.Cooldown
+	if cooldown <= 0 {
+		cooldown = defaultAutoscaleCooldown
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastScaled time.Time
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if time.Since(lastScaled) < cooldown {
+				continue
+			}
+
+			depth, err := w.queueDepth(ctx)
+			if err != nil {
+				cErr.Printf("Error reading queue depth: %v \n", err)
+				continue
+			}
+
+			current := w.poolSize()
+			desired := cfg.desiredWorkers(depth)
+			if desired == current {
+				continue
+			}
+
+			c.Printf("Queue depth %d, scaling workers from %d to %d \n", depth, current, desired)
+			w.scaleTo(ctx, desired)
+			lastScaled = time.Now()
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package sqs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/aws/smithy-go"
+)
+
+const (
+	defaultReceiveBackoffBase = 100 * time.Millisecond
+	defaultReceiveBackoffMax  = 30 * time.Second
+)
+
+// Error codes that will not go away by retrying the same request
+var nonRetryableErrorCodes = map[string]struct{}{
+	"AWS.SimpleQueueService.NonExistentQueue": {},
+	"QueueDoesNotExist":                       {},
+	"AccessDenied":                            {},
+	"AccessDeniedException":                   {},
+	"InvalidClientTokenId":                    {},
+	"UnrecognizedClientException":             {},
+	"InvalidAddress":                          {},
+}
+
+// isRetryable reports whether a failed ReceiveMessage call is worth retrying
+func isRetryable(err error) bool {
+	var notExist *types.QueueDoesNotExist
+	if errors.As(err, &notExist) {
+		return false
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		if _, ok := nonRetryableErrorCodes[apiErr.ErrorCode()]; ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// backoff computes jittered exponential delays between failed calls
+type backoff struct {
+	base    time.Duration
+	max     time.Duration
+	attempt int
+}
+
+func newBackoff(base time.Duration, max time.Duration) *backoff {
+	if base <= 0 {
+		base = defaultReceiveBackoffBase
+	}
+	if max <= 0 {
+		max = defaultReceiveBackoffMax
+	}
+	return &backoff{base: base, max: max}
+}
+
+// next returns a random delay between zero and the current exponential
+// ceiling, and raises the ceiling for the following call
+func (b *backoff) next() time.Duration {
+	ceiling := b.max
+	if b.attempt < 32 {
+		ceiling = min(b.base<<b.attempt, b.max)
+	}
+	b.attempt++
+
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+func (b *backoff) reset() {
+	b.attempt = 0
+}
+
+// wait sleeps for the next backoff delay. It returns false if the poller
+// was stopped in the meantime.
+func (b *backoff) wait(ctx context.Context, stop <-chan struct{}) bool {
+	timer := time.NewTimer(b.next())
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-stop:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// circuitBreaker trips after a number of consecutive failures across all
+// pollers. A zero threshold never trips.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	failures  int
+}
+
+// success resets the consecutive failure count
+func (cb *circuitBreaker) success() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.failures = 0
+}
+
+// failure records a failure and reports whether the breaker tripped
+func (cb *circuitBreaker) failure() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.failures++
+	return cb.threshold > 0 && cb.failures >= cb.threshold
+}
+
+// fail reports a fatal error to the caller of StartSqsConsumer. Only the
+// first error is kept.
+func (w *Worker) fail(err error) {
+	select {
+	case w.fatal <- err:
+	default:
+	}
+}
+
+// receiveFailed handles a failed ReceiveMessage call. It returns false when
+// the poller should stop.
+func (w *Worker) receiveFailed(ctx context.Context, stop <-chan struct{}, b *backoff, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	cErr.Printf("Error receiving message: %v \n", err)
+
+	if !isRetryable(err) {
+		w.fail(fmt.Errorf("non-retryable error receiving messages: %w", err))
+		return false
+	}
+
+	if w.breaker.failure() {
+		w.fail(fmt.Errorf("circuit breaker tripped after %d consecutive receive failures: %w", w.breaker.threshold, err))
+		return false
+	}
+
+	return b.wait(ctx, stop)
+}
@@ -0,0 +1,128 @@
+package sqs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	blobstore "github.com/debojitroy/aws-queue-tasks-consume/internal/services/blobstore"
+)
+
+// ClaimCheckAttribute marks messages whose body is a pointer to a blob
+const ClaimCheckAttribute = "claim_check"
+
+// SQS limits a message, and a whole batch, to 256 KiB
+const maxMessageBytes = 256 * 1024
+
+// errClaimCheckDiscarded is returned for a claim check whose blob is gone.
+// Blobs are deleted once their message was processed, so the message is
+// likely a redelivered duplicate, which only the handler can tell.
+var errClaimCheckDiscarded = errors.New("claim-checked blob already discarded")
+
+// claimCheck is the body sent in place of an oversized message
+type claimCheck struct {
+	Store string `json:"store"`
+	// Location of the store, empty in pointers written before it was recorded
+	Location string `json:"location,omitempty"`
+	Key      string `json:"key"`
+}
+
+// EnableClaimCheck stores message bodies larger than threshold bytes in the
+// blob store and sends a pointer instead. A threshold of zero uses the SQS
+// message size limit.
+func (sqsClient *SqsClient) EnableClaimCheck(store blobstore.Store, threshold int) {
+	if threshold <= 0 || threshold > maxMessageBytes {
+		threshold = maxMessageBytes
+	}
+
+	sqsClient.claimCheckStore = store
+	sqsClient.claimCheckThreshold = threshold
+}
+
+// messageSize approximates the size SQS accounts for a message
+func messageSize(body string, attributes map[string]types.MessageAttributeValue) int {
+	size := len(body)
+	for name, attr := range attributes {
+		size += len(name) + len(aws.ToString(attr.DataType)) + len(aws.ToString(attr.StringValue)) + len(attr.BinaryValue)
+	}
+	return size
+}
+
+// claimCheckKey is the blob key of an entity message
+func claimCheckKey(entry *types.SendMessageBatchRequestEntry) string {
+	return aws.ToString(entry.MessageAttributes[EntityIdAttribute].StringValue) + "/" +
+		aws.ToString(entry.MessageAttributes[MessageIdAttribute].StringValue)
+}
+
+// checkIn moves an oversized body of the entry to the blob store and points
+// the entry at it
+func (sqsClient *SqsClient) checkIn(ctx context.Context, key string, entry *types.SendMessageBatchRequestEntry) error {
+	if sqsClient.claimCheckStore == nil || messageSize(*entry.MessageBody, entry.MessageAttributes) <= sqsClient.claimCheckThreshold {
+		return nil
+	}
+
+	if err := sqsClient.claimCheckStore.Put(ctx, key, []byte(*entry.MessageBody)); err != nil {
+		return fmt.Errorf("failed to store claim-checked body: %w", err)
+	}
+
+	pointer, err := json.Marshal(claimCheck{
+		Store:    sqsClient.claimCheckStore.Name(),
+		Location: sqsClient.claimCheckStore.Location(),
+		Key:      key,
+	})
+	if err != nil {
+		return err
+	}
+
+	entry.MessageBody = aws.String(string(pointer))
+	entry.MessageAttributes[ClaimCheckAttribute] = types.MessageAttributeValue{
+		DataType:    aws.String("String"),
+		StringValue: aws.String(sqsClient.claimCheckStore.Name()),
+	}
+	return nil
+}
+
+// checkOut returns a copy of the message carrying the stored body, along with
+// the blob key, when the message is a claim check. Other messages are
+// returned as is. Claim checks whose blob is gone fail with
+// errClaimCheckDiscarded.
+func (w *Worker) checkOut(ctx context.Context, msg *types.Message) (*types.Message, string, error) {
+	if _, ok := msg.MessageAttributes[ClaimCheckAttribute]; !ok {
+		return msg, "", nil
+	}
+
+	var pointer claimCheck
+	if err := json.Unmarshal([]byte(aws.ToString(msg.Body)), &pointer); err != nil || pointer.Key == "" {
+		return nil, "", NewInvalidMessageError("malformed claim check")
+	}
+
+	store := w.Config.ClaimCheckStore
+	if store == nil || store.Name() != pointer.Store {
+		return nil, "", NewInvalidMessageError("no %q blob store configured for claim check", pointer.Store)
+	}
+	if pointer.Location != "" && pointer.Location != store.Location() {
+		return nil, "", NewInvalidMessageError("claim check stored in %s, but the blob store reads %s", pointer.Location, store.Location())
+	}
+
+	body, err := store.Get(ctx, pointer.Key)
+	if errors.Is(err, blobstore.ErrNotFound) {
+		return nil, "", fmt.Errorf("claim check %s: %w", pointer.Key, errClaimCheckDiscarded)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to resolve claim check %s: %w", pointer.Key, err)
+	}
+
+	resolved := *msg
+	resolved.Body = aws.String(string(body))
+	return &resolved, pointer.Key, nil
+}
+
+// discardBlob deletes the blob of a claim check once its message is deleted
+func (w *Worker) discardBlob(key string) {
+	if err := w.Config.ClaimCheckStore.Delete(context.Background(), key); err != nil {
+		cErr.Printf("Error deleting claim-checked blob %s: %v \n", key, err)
+	}
+}
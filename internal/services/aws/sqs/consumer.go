@@ -3,40 +3,143 @@ package sqs
 import (
 	"context"
 	"fmt"
-	"log"
-	"os"
-	"os/signal"
 	"sync"
-	"syscall"
+	"sync/atomic"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	blobstore "github.com/debojitroy/aws-queue-tasks-consume/internal/services/blobstore"
+	tracing "github.com/debojitroy/aws-queue-tasks-consume/internal/services/tracing"
 	color "github.com/fatih/color"
 )
 
-type Handler func(ctx context.Context, msg *types.Message, region string, tableName string) error
-
 type Config struct {
-	TableName       string
+	// QueueURL is the queue to consume from, unless Queues is set
 	QueueURL        string
 	Region          string
 	NumWorkers      int
 	BatchSize       int32
 	WaitTimeSeconds int32
+
+	// NumWorkers above is the number of pollers receiving messages.
+	// NumProcessors is the number of messages handled concurrently and
+	// defaults to NumWorkers, or Autoscale.MaxWorkers when autoscaling, but at
+	// least one.
+	NumProcessors int
+	// BufferSize bounds the received messages waiting for a processor.
+	// Defaults to BatchSize.
+	BufferSize int
+
+	// VisibilityTimeout (in seconds) is requested on receive and re-applied on
+	// every heartbeat. Zero keeps the queue default.
+	VisibilityTimeout int32
+	// HeartbeatInterval controls how often the visibility of a message is
+	// extended while its handler runs. Zero disables heartbeating.
+	HeartbeatInterval time.Duration
+
+	// DeleteFlushInterval is the longest a processed message waits before
+	// its batched delete is sent. Defaults to one second.
+	DeleteFlushInterval time.Duration
+	// DeleteRetries bounds how often failed delete entries are retried.
+	// Defaults to three.
+	DeleteRetries int
+
+	// MaxReceiveCount is the number of receives after which a failing
+	// message is quarantined. Zero retries failing messages forever.
+	MaxReceiveCount int32
+	// DeadLetterQueueURL receives quarantined messages. When empty,
+	// quarantined messages are only logged and deleted.
+	DeadLetterQueueURL string
+
+	// Autoscale grows and shrinks the number of workers with the queue
+	// depth. When nil, NumWorkers workers run for the lifetime of the consumer.
+	Autoscale *AutoscaleConfig
+
+	// ReceiveBackoffBase and ReceiveBackoffMax bound the jittered exponential
+	// backoff after failed receives. They default to 100ms and 30s.
+	ReceiveBackoffBase time.Duration
+	ReceiveBackoffMax  time.Duration
+	// CircuitBreakerThreshold is the number of consecutive receive failures
+	// after which the consumer gives up. Zero never gives up.
+	CircuitBreakerThreshold int
+
+	// FIFO handles the messages of one message group in sequence. It is
+	// enabled automatically for queues whose URL ends in ".fifo".
+	FIFO bool
+
+	// Middlewares wrap the handler, the first one being the outermost
+	Middlewares []Middleware
+
+	// DrainTimeout bounds how long in-flight messages may keep processing
+	// after shutdown starts. Defaults to 30 seconds.
+	DrainTimeout time.Duration
+
+	// Dependencies are handed to every handler invocation
+	Dependencies *Dependencies
+
+	// Queues lists several queues sharing the worker pool, polled according
+	// to PollStrategy (weighted by default)
+	Queues       []QueueConfig
+	PollStrategy PollStrategy
+
+	// ClaimCheckStore resolves messages whose body was moved to a blob store
+	// by the producer. The blob is deleted once the message is deleted.
+	ClaimCheckStore blobstore.Store
 }
 
+const defaultDrainTimeout = 30 * time.Second
+
 type Worker struct {
 	Config *Config
 	Input  *sqs.ReceiveMessageInput
 	Sqs    *sqs.Client
 	Events map[string]interface{}
+
+	queues      []*queue
+	quarantined quarantineCounter
+
+	// stop channels of the running pollers, used to resize the pool
+	poolMu  sync.Mutex
+	pool    []chan struct{}
+	nextID  int
+	pollers sync.WaitGroup
+
+	// buffer hands received messages to the processors. In FIFO mode each
+	// processor reads from its own shard instead. slots holds one token per
+	// message that is received but not yet processed.
+	buffer     chan *inflight
+	shards     []chan *inflight
+	slots      chan struct{}
+	processors sync.WaitGroup
+	batches    atomic.Uint64
+
+	breaker *circuitBreaker
+	fatal   chan error
+
+	// processCtx outlives the polling context so that in-flight messages can
+	// finish during the drain phase
+	processCtx context.Context
+	draining   atomic.Bool
+
+	deps *Dependencies
 }
 
 var c = color.New(color.FgHiGreen)
 var cErr = color.New(color.FgRed).Add(color.Bold)
 
 func NewWorker(cfg *Config) (*Worker, error) {
+	if cfg.HeartbeatInterval > 0 {
+		if cfg.VisibilityTimeout <= 0 {
+			return nil, fmt.Errorf("visibility timeout is required when heartbeat is enabled")
+		}
+		if cfg.HeartbeatInterval >= time.Duration(cfg.VisibilityTimeout)*time.Second {
+			return nil, fmt.Errorf("heartbeat interval %s must be shorter than visibility timeout %ds", cfg.HeartbeatInterval, cfg.VisibilityTimeout)
+		}
+	}
+
 	// Load AWS configuration
 	awsCfg, err := config.LoadDefaultConfig(context.TODO(),
 		config.WithRegion(cfg.Region))
@@ -44,97 +147,262 @@ func NewWorker(cfg *Config) (*Worker, error) {
 		return nil, fmt.Errorf("unable to load SDK config: %v", err)
 	}
 
+	// Trace every AWS call made with the config
+	tracing.InstrumentAWS(&awsCfg)
+
 	// Create SQS client
 	sqsClient := sqs.NewFromConfig(awsCfg)
 
-	// Configure receive message input
-	input := &sqs.ReceiveMessageInput{
-		QueueUrl:              &cfg.QueueURL,
-		MaxNumberOfMessages:   cfg.BatchSize,
-		WaitTimeSeconds:       cfg.WaitTimeSeconds,
-		MessageAttributeNames: []string{"All"},
+	queueConfigs, err := cfg.queueConfigs()
+	if err != nil {
+		return nil, err
+	}
+
+	var queues []*queue
+	for _, qc := range queueConfigs {
+		// Configure receive message input
+		input := &sqs.ReceiveMessageInput{
+			QueueUrl:              aws.String(qc.URL),
+			MaxNumberOfMessages:   cfg.BatchSize,
+			WaitTimeSeconds:       cfg.WaitTimeSeconds,
+			VisibilityTimeout:     cfg.VisibilityTimeout,
+			MessageAttributeNames: []string{"All"},
+			MessageSystemAttributeNames: []types.MessageSystemAttributeName{
+				types.MessageSystemAttributeNameApproximateReceiveCount,
+				types.MessageSystemAttributeNameMessageGroupId,
+			},
+		}
+
+		queues = append(queues, &queue{
+			QueueConfig: qc,
+			fifo:        cfg.FIFO || IsFifoQueue(qc.URL),
+			input:       input,
+			acker:       newAcknowledger(sqsClient, qc.URL, cfg.DeleteFlushInterval, cfg.DeleteRetries),
+		})
+	}
+
+	if cfg.Autoscale != nil {
+		if err := cfg.Autoscale.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.NumProcessors <= 0 {
+		cfg.NumProcessors = cfg.NumWorkers
+		if cfg.Autoscale != nil {
+			cfg.NumProcessors = max(cfg.NumProcessors, cfg.Autoscale.MaxWorkers)
+		}
+		// Without a processor received messages are never handled
+		cfg.NumProcessors = max(cfg.NumProcessors, 1)
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = int(cfg.BatchSize)
 	}
 
-	return &Worker{
+	w := &Worker{
 		Config: cfg,
-		Input:  input,
+		Input:  queues[0].input,
 		Sqs:    sqsClient,
 		Events: make(map[string]interface{}),
-	}, nil
+		queues: queues,
+		deps:   cfg.Dependencies.withDefaults(),
+		buffer: make(chan *inflight, cfg.BufferSize),
+		slots:  make(chan struct{}, cfg.BufferSize+cfg.NumProcessors),
+
+		breaker: &circuitBreaker{threshold: cfg.CircuitBreakerThreshold},
+		fatal:   make(chan error, 1),
+	}
+
+	if w.hasFifoQueue() {
+		// Every shard can take all messages the slots allow, so dispatching never blocks
+		for range cfg.NumProcessors {
+			w.shards = append(w.shards, make(chan *inflight, cfg.BufferSize+cfg.NumProcessors))
+		}
+	}
+
+	return w, nil
+}
+
+// hasFifoQueue reports whether any of the polled queues is a FIFO queue
+func (w *Worker) hasFifoQueue() bool {
+	for _, q := range w.queues {
+		if q.fifo {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Worker) start(ctx context.Context, handler Handler) {
+	for _, q := range w.queues {
+		q.acker.start()
+	}
+	w.startProcessors(w.processCtx, Chain(handler, w.Config.Middlewares...))
+
+	if w.Config.Autoscale == nil {
+		w.scaleTo(ctx, w.Config.NumWorkers)
+		return
+	}
+
+	w.scaleTo(ctx, w.Config.Autoscale.clamp(w.Config.NumWorkers))
+
+	w.pollers.Add(1)
+	go w.autoscale(ctx)
 }
 
-func (w *Worker) start(ctx context.Context, handler Handler, wg *sync.WaitGroup) {
-	for i := 0; i < w.Config.NumWorkers; i++ {
-		wg.Add(1)
-		go w.consume(ctx, i, handler, wg)
+// shutdown waits for the pollers to stop, lets the processors finish their
+// in-flight messages and release the buffered ones, and flushes pending
+// deletes. The polling context must be cancelled first.
+func (w *Worker) shutdown() {
+	w.draining.Store(true)
+	w.pollers.Wait()
+	close(w.buffer)
+	for _, shard := range w.shards {
+		close(shard)
+	}
+	w.processors.Wait()
+	for _, q := range w.queues {
+		q.acker.stop()
 	}
 }
 
-func (w *Worker) consume(ctx context.Context, workerID int, handler Handler, wg *sync.WaitGroup) {
-	defer wg.Done()
+// poolSize returns the number of running pollers
+func (w *Worker) poolSize() int {
+	w.poolMu.Lock()
+	defer w.poolMu.Unlock()
+
+	return len(w.pool)
+}
+
+// scaleTo starts or stops pollers until n are running. Stopped pollers hand
+// over the batch they received before exiting.
+func (w *Worker) scaleTo(ctx context.Context, n int) {
+	w.poolMu.Lock()
+	defer w.poolMu.Unlock()
+
+	for len(w.pool) < n {
+		stop := make(chan struct{})
+		w.pool = append(w.pool, stop)
+
+		w.pollers.Add(1)
+		go w.poll(ctx, w.nextID, stop)
+		w.nextID++
+	}
+
+	for len(w.pool) > n {
+		last := len(w.pool) - 1
+		close(w.pool[last])
+		w.pool = w.pool[:last]
+	}
+}
+
+// poll receives messages and feeds them to the processors. Polling pauses
+// while the buffer is full.
+func (w *Worker) poll(ctx context.Context, workerID int, stop <-chan struct{}) {
+	defer w.pollers.Done()
 	c.Printf("Starting worker %d \n", workerID)
 
+	b := newBackoff(w.Config.ReceiveBackoffBase, w.Config.ReceiveBackoffMax)
+
 	for {
 		select {
 		case <-ctx.Done():
 			c.Printf("Worker %d shutting down \n", workerID)
 			return
-		default:
+		case <-stop:
+			c.Printf("Worker %d scaled down \n", workerID)
+			return
+		case w.slots <- struct{}{}:
+			// Reserve room for as much of a batch as the buffer can take
+			reserved := 1
+			for reserved < int(w.Config.BatchSize) && w.tryReserve() {
+				reserved++
+			}
+
 			// Receive messages
-			output, err := w.Sqs.ReceiveMessage(ctx, w.Input)
+			q, output, err := w.receive(ctx, int32(reserved))
 			if err != nil {
-				cErr.Printf("Error receiving message: %v \n", err)
+				w.release(reserved)
+				if !w.receiveFailed(ctx, stop, b, err) {
+					c.Printf("Worker %d stopped \n", workerID)
+					return
+				}
 				continue
 			}
 
-			// Process messages
-			for _, message := range output.Messages {
-				if err := handler(ctx, &message, w.Config.Region, w.Config.TableName); err != nil {
-					cErr.Printf("Error processing message: %v \n", err)
-					continue
-				}
+			b.reset()
+			w.breaker.success()
+			w.release(reserved - len(output.Messages))
 
-				// Delete message after successful processing
-				_, err := w.Sqs.DeleteMessage(ctx, &sqs.DeleteMessageInput{
-					QueueUrl:      &w.Config.QueueURL,
-					ReceiptHandle: message.ReceiptHandle,
+			batch := w.batches.Add(1)
+			for _, message := range output.Messages {
+				// Keep the message invisible to other workers until it is processed
+				w.dispatch(&inflight{
+					msg:           message,
+					queue:         q,
+					batch:         batch,
+					stopHeartbeat: w.startHeartbeat(w.processCtx, q, &message),
 				})
-				if err != nil {
-					cErr.Printf("Error deleting message: %v \n", err)
-				}
 			}
 		}
 	}
 }
 
-func StartSqsConsumer(messageHandler Handler, cfg *Config) {
-	worker, err := NewWorker(cfg)
-	if err != nil {
-		log.Fatalf("Error creating worker: %v \n", err)
-	}
+// Run consumes messages until the context is cancelled or the worker gives
+// up on receiving messages, in which case the error is returned. On
+// cancellation, polling stops, in-flight messages are given DrainTimeout to
+// finish and buffered messages are released back to the queue.
+func (w *Worker) Run(ctx context.Context, handler Handler) error {
+	pollCtx, cancelPolling := context.WithCancel(ctx)
+	defer cancelPolling()
 
-	// Create context that can be canceled
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	// Use WaitGroup to wait for all workers to finish
-	var wg sync.WaitGroup
+	processCtx, cancelProcessing := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelProcessing()
+	w.processCtx = processCtx
 
 	// Start the workers
-	worker.start(ctx, messageHandler, &wg)
+	w.start(pollCtx, handler)
+
+	// Wait for cancellation or a fatal error
+	var fatalErr error
+	select {
+	case <-ctx.Done():
+		c.Println("Shutting down gracefully...")
+	case fatalErr = <-w.fatal:
+		cErr.Printf("Shutting down after fatal error: %v \n", fatalErr)
+	}
 
-	// Handle graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	// Stop polling, then drain
+	cancelPolling()
 
-	// Wait for interrupt signal
-	<-sigChan
-	c.Println("Shutting down gracefully...")
+	drainTimeout := w.Config.DrainTimeout
+	if drainTimeout <= 0 {
+		drainTimeout = defaultDrainTimeout
+	}
+	timer := time.AfterFunc(drainTimeout, cancelProcessing)
+	defer timer.Stop()
 
-	// Cancel context to stop workers
-	cancel()
+	w.shutdown()
 
-	// Wait for all workers to finish
-	wg.Wait()
+	for entityId, count := range w.QuarantinedCounts() {
+		cErr.Printf("Entity Id %s: %d messages quarantined \n", entityId, count)
+	}
+	for queueURL, count := range w.ReceiveErrorCounts() {
+		cErr.Printf("Queue %s: %d receives failed \n", queueURL, count)
+	}
 	c.Println("Shutdown complete")
+
+	return fatalErr
+}
+
+// StartSqsConsumer creates a worker and runs it until the context is
+// cancelled. It returns an error if the worker cannot be created or gives
+// up on receiving messages.
+func StartSqsConsumer(ctx context.Context, messageHandler Handler, cfg *Config) error {
+	worker, err := NewWorker(cfg)
+	if err != nil {
+		return fmt.Errorf("error creating worker: %w", err)
+	}
+
+	return worker.Run(ctx, messageHandler)
 }
@@ -0,0 +1,159 @@
+package sqs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// Message attributes added to messages forwarded to the dead-letter queue
+const (
+	FailureReasonAttribute       = "failure_reason"
+	FailureReceiveCountAttribute = "failure_receive_count"
+	FailureSourceQueueAttribute  = "failure_source_queue"
+)
+
+// InvalidMessageError marks a message that can never be processed
+// successfully. Such messages are quarantined without waiting for the
+// maximum receive count.
+type InvalidMessageError struct {
+	Reason string
+}
+
+func (e *InvalidMessageError) Error() string {
+	return "invalid message: " + e.Reason
+}
+
+// NewInvalidMessageError creates an InvalidMessageError with a formatted reason
+func NewInvalidMessageError(format string, args ...any) error {
+	return &InvalidMessageError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// quarantineCounter counts quarantined messages per entity
+type quarantineCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (q *quarantineCounter) inc(entityId string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.counts == nil {
+		q.counts = make(map[string]int)
+	}
+	q.counts[entityId]++
+}
+
+func (q *quarantineCounter) snapshot() map[string]int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return maps.Clone(q.counts)
+}
+
+// receiveCount returns the ApproximateReceiveCount of the message, or 0 when
+// SQS did not report it
+func receiveCount(msg *types.Message) int {
+	count, err := strconv.Atoi(msg.Attributes[string(types.MessageSystemAttributeNameApproximateReceiveCount)])
+	if err != nil {
+		return 0
+	}
+	return count
+}
+
+// quarantineReason decides whether a message should be moved out of the main
+// queue, given the error returned by its handler (nil if it was not run yet).
+func (w *Worker) quarantineReason(msg *types.Message, handlerErr error) (string, bool) {
+	var invalid *InvalidMessageError
+	if errors.As(handlerErr, &invalid) {
+		return invalid.Error(), true
+	}
+
+	maxReceive := int(w.Config.MaxReceiveCount)
+	if maxReceive <= 0 {
+		return "", false
+	}
+
+	count := receiveCount(msg)
+	if handlerErr == nil && count > maxReceive {
+		return fmt.Sprintf("receive count %d exceeds maximum of %d", count, maxReceive), true
+	}
+	if handlerErr != nil && count >= maxReceive {
+		return fmt.Sprintf("failed after %d receives: %v", count, handlerErr), true
+	}
+
+	return "", false
+}
+
+// quarantine forwards the message to the dead-letter queue, when one is
+// configured, and removes it from the main queue. It returns false if the
+// message could not be forwarded and was left on the main queue.
+func (w *Worker) quarantine(ctx context.Context, item *inflight, reason string) bool {
+	msg := &item.msg
+
+	entityId := "unknown"
+	if attr, ok := msg.MessageAttributes[EntityIdAttribute]; ok && attr.StringValue != nil {
+		entityId = *attr.StringValue
+	}
+
+	cErr.Printf("Quarantining message %s for Entity Id %s: %s \n", *msg.MessageId, entityId, reason)
+
+	if w.Config.DeadLetterQueueURL != "" {
+		attributes := maps.Clone(msg.MessageAttributes)
+		if attributes == nil {
+			attributes = make(map[string]types.MessageAttributeValue)
+		}
+		attributes[FailureReasonAttribute] = types.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(reason),
+		}
+		attributes[FailureReceiveCountAttribute] = types.MessageAttributeValue{
+			DataType:    aws.String("Number"),
+			StringValue: aws.String(strconv.Itoa(receiveCount(msg))),
+		}
+		attributes[FailureSourceQueueAttribute] = types.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(item.queue.URL),
+		}
+
+		input := &sqs.SendMessageInput{
+			QueueUrl:          &w.Config.DeadLetterQueueURL,
+			MessageBody:       msg.Body,
+			MessageAttributes: attributes,
+		}
+
+		// A FIFO dead-letter queue keeps the group of the original message
+		if IsFifoQueue(w.Config.DeadLetterQueueURL) {
+			group := messageGroupId(msg)
+			if group == "" {
+				group = entityId
+			}
+			input.MessageGroupId = aws.String(group)
+			input.MessageDeduplicationId = msg.MessageId
+		}
+
+		_, err := w.Sqs.SendMessage(ctx, input)
+		if err != nil {
+			// Leave the message on the main queue so it is not lost
+			cErr.Printf("Error forwarding message %s to dead-letter queue: %v \n", *msg.MessageId, err)
+			return false
+		}
+	}
+
+	w.quarantined.inc(entityId)
+	item.queue.acker.ack(msg)
+	return true
+}
+
+// QuarantinedCounts returns the number of quarantined messages per entity
+func (w *Worker) QuarantinedCounts() map[string]int {
+	return w.quarantined.snapshot()
+}
@@ -0,0 +1,91 @@
+package sqs
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	scheduler "github.com/debojitroy/aws-queue-tasks-consume/internal/services/scheduler"
+)
+
+// SQS delays a single message by at most 15 minutes
+const maxDelay = 15 * time.Minute
+
+// EnableScheduler hands messages that cannot be delayed by SQS itself (longer
+// than 15 minutes, or any delay on FIFO queues) to the scheduler store
+func (sqsClient *SqsClient) EnableScheduler(store scheduler.Store) {
+	sqsClient.schedulerStore = store
+}
+
+// NeedsScheduler reports whether SQS cannot delay a message by delay itself,
+// so that it has to go through the scheduler store
+func (sqsClient *SqsClient) NeedsScheduler(delay time.Duration) bool {
+	return delay > 0 && (sqsClient.fifo || delay > maxDelay)
+}
+
+// delay postpones the entry. It returns true if the entry was handed to the
+// scheduler and must not be sent now.
+func (sqsClient *SqsClient) delay(ctx context.Context, entry *types.SendMessageBatchRequestEntry, delay time.Duration) (bool, error) {
+	if delay <= 0 {
+		return false, nil
+	}
+
+	// FIFO queues only support a queue-wide delay
+	if !sqsClient.NeedsScheduler(delay) {
+		entry.DelaySeconds = int32((delay + time.Second - 1) / time.Second)
+		return false, nil
+	}
+
+	if sqsClient.schedulerStore == nil {
+		return false, fmt.Errorf("delay of %s requires a scheduler store", delay)
+	}
+
+	attributes := make(map[string]string, len(entry.MessageAttributes))
+	for name, attr := range entry.MessageAttributes {
+		attributes[name] = aws.ToString(attr.StringValue)
+	}
+
+	task := scheduler.Task{
+		Id:              claimCheckKey(entry),
+		QueueUrl:        sqsClient.queueUrl,
+		Body:            aws.ToString(entry.MessageBody),
+		Attributes:      attributes,
+		GroupId:         aws.ToString(entry.MessageGroupId),
+		DeduplicationId: aws.ToString(entry.MessageDeduplicationId),
+		DueAt:           time.Now().Add(delay),
+	}
+
+	if err := sqsClient.schedulerStore.Add(ctx, task); err != nil {
+		return false, fmt.Errorf("failed to schedule message: %w", err)
+	}
+	return true, nil
+}
+
+// SendTask enqueues a scheduled task that became due
+func (sqsClient *SqsClient) SendTask(ctx context.Context, task scheduler.Task) error {
+	attributes := make(map[string]types.MessageAttributeValue, len(task.Attributes))
+	for name, value := range task.Attributes {
+		attributes[name] = types.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(value),
+		}
+	}
+
+	input := &sqs.SendMessageInput{
+		QueueUrl:          aws.String(task.QueueUrl),
+		MessageBody:       aws.String(task.Body),
+		MessageAttributes: attributes,
+	}
+	if task.GroupId != "" {
+		input.MessageGroupId = aws.String(task.GroupId)
+	}
+	if task.DeduplicationId != "" {
+		input.MessageDeduplicationId = aws.String(task.DeduplicationId)
+	}
+
+	_, err := sqsClient.client.SendMessage(ctx, input)
+	return err
+}
@@ -0,0 +1,37 @@
+package sqs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/fnv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// IsFifoQueue reports whether the queue URL points to a FIFO queue
+func IsFifoQueue(queueUrl string) bool {
+	return strings.HasSuffix(queueUrl, ".fifo")
+}
+
+// deduplicationId derives a stable deduplication id for an entity message,
+// so that re-sending the same message within the deduplication window is a
+// no-op
+func deduplicationId(entityId string, messageId string) string {
+	sum := sha256.Sum256([]byte(entityId + ":" + messageId))
+	return hex.EncodeToString(sum[:])
+}
+
+// messageGroupId returns the FIFO message group of the message, or an empty
+// string for standard queues
+func messageGroupId(msg *types.Message) string {
+	return msg.Attributes[string(types.MessageSystemAttributeNameMessageGroupId)]
+}
+
+// shardFor picks the processor that owns the message group, so that all
+// messages of one group are handled in sequence by the same processor
+func (w *Worker) shardFor(group string) chan *inflight {
+	h := fnv.New32a()
+	h.Write([]byte(group))
+	return w.shards[h.Sum32()%uint32(len(w.shards))]
+}
@@ -0,0 +1,52 @@
+package sqs
+
+import (
+	"context"
+	"log"
+)
+
+// Handler processes a single message. Returning an error leaves the message
+// on the queue for a retry.
+type Handler func(ctx context.Context, mc *MessageContext) error
+
+// CounterStore decrements the number of messages remaining for an entity
+// of a run
+type CounterStore interface {
+	DecrementMessageCount(ctx context.Context, runId string, entityId string, decrementCount int) error
+}
+
+// Dependencies are the long-lived clients shared by all handlers. They are
+// created once, before the consumer starts.
+type Dependencies struct {
+	Counters CounterStore
+	Logger   *log.Logger
+	Metrics  *HandlerMetrics
+}
+
+// MessageContext is passed to handlers for every message
+type MessageContext struct {
+	*Dependencies
+
+	Message *Message
+	// ReceiveCount is the number of times the message was received,
+	// including this time
+	ReceiveCount int
+	// QueueURL is the queue the message was received from
+	QueueURL string
+}
+
+// withDefaults fills in the dependencies that were not provided
+func (d *Dependencies) withDefaults() *Dependencies {
+	deps := &Dependencies{}
+	if d != nil {
+		*deps = *d
+	}
+
+	if deps.Logger == nil {
+		deps.Logger = log.Default()
+	}
+	if deps.Metrics == nil {
+		deps.Metrics = &HandlerMetrics{}
+	}
+	return deps
+}
@@ -0,0 +1,49 @@
+package sqs
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// startHeartbeat keeps extending the visibility timeout of the message until
+// the returned stop function is called. It is a no-op when heartbeating is
+// not configured.
+func (w *Worker) startHeartbeat(ctx context.Context, q *queue, msg *types.Message) (stop func()) {
+	if w.Config.HeartbeatInterval <= 0 {
+		return func() {}
+	}
+
+	hbCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(w.Config.HeartbeatInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-hbCtx.Done():
+				return
+			case <-ticker.C:
+				_, err := w.Sqs.ChangeMessageVisibility(hbCtx, &sqs.ChangeMessageVisibilityInput{
+					QueueUrl:          &q.URL,
+					ReceiptHandle:     msg.ReceiptHandle,
+					VisibilityTimeout: w.Config.VisibilityTimeout,
+				})
+				if err != nil && hbCtx.Err() == nil {
+					cErr.Printf("Error extending visibility for message %s: %v \n", *msg.MessageId, err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
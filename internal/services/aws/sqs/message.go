@@ -0,0 +1,95 @@
+package sqs
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	message "github.com/debojitroy/aws-queue-tasks-consume/internal/services/message"
+)
+
+// ContentTypeAttribute names the codec used to encode the message body
+const ContentTypeAttribute = "content_type"
+
+// Message is a received SQS message along with its decoded envelope
+type Message struct {
+	types.Message
+	Envelope *message.Envelope
+
+	// BodyDiscarded marks a claim check whose blob was already deleted. Its
+	// envelope is rebuilt from the message attributes and has no payload.
+	// Handlers must only acknowledge it once they know the message was
+	// processed before, and quarantine it otherwise.
+	BodyDiscarded bool
+}
+
+// RunId returns the run the message belongs to, taken from the run_id
+// attribute or else from the envelope
+func (m *Message) RunId() string {
+	if attr, ok := m.MessageAttributes[RunIdAttribute]; ok && aws.ToString(attr.StringValue) != "" {
+		return *attr.StringValue
+	}
+	if m.Envelope != nil {
+		return m.Envelope.RunId
+	}
+	return ""
+}
+
+// decode resolves the envelope of the message using the codec named in its
+// content type attribute. Messages without one are decoded as legacy
+// messages.
+func decode(msg *types.Message) (*Message, error) {
+	body := aws.ToString(msg.Body)
+
+	contentType, ok := msg.MessageAttributes[ContentTypeAttribute]
+	if !ok {
+		entityId := aws.ToString(msg.MessageAttributes[EntityIdAttribute].StringValue)
+		messageId := aws.ToString(msg.MessageAttributes[MessageIdAttribute].StringValue)
+		if entityId == "" || messageId == "" {
+			return nil, NewInvalidMessageError("legacy message without %s and %s attributes", EntityIdAttribute, MessageIdAttribute)
+		}
+
+		envelope, err := message.FromLegacy(body, entityId, messageId)
+		if err != nil {
+			return nil, NewInvalidMessageError("%v", err)
+		}
+		return &Message{Message: *msg, Envelope: envelope}, nil
+	}
+
+	codec, err := message.CodecFor(aws.ToString(contentType.StringValue))
+	if err != nil {
+		return nil, NewInvalidMessageError("%v", err)
+	}
+
+	envelope, err := codec.Decode(body)
+	if err != nil {
+		return nil, NewInvalidMessageError("cannot decode %s body: %v", codec.ContentType(), err)
+	}
+
+	// Envelopes written before message types were introduced only carried
+	// entity messages
+	if envelope.MessageType == "" && envelope.SchemaVersion == 1 {
+		envelope.MessageType = message.EntityMessageType
+	}
+
+	return &Message{Message: *msg, Envelope: envelope}, nil
+}
+
+// decodeDiscarded rebuilds the envelope of a claim check whose blob is gone
+// from the message attributes
+func decodeDiscarded(msg *types.Message) (*Message, error) {
+	entityId := aws.ToString(msg.MessageAttributes[EntityIdAttribute].StringValue)
+	messageId := aws.ToString(msg.MessageAttributes[MessageIdAttribute].StringValue)
+	if entityId == "" || messageId == "" {
+		return nil, NewInvalidMessageError("discarded claim check without %s and %s attributes", EntityIdAttribute, MessageIdAttribute)
+	}
+
+	envelope, err := message.FromLegacy("", entityId, messageId)
+	if err != nil {
+		return nil, NewInvalidMessageError("%v", err)
+	}
+	if messageType := aws.ToString(msg.MessageAttributes[MessageTypeAttribute].StringValue); messageType != "" {
+		envelope.MessageType = messageType
+	}
+	envelope.RunId = aws.ToString(msg.MessageAttributes[RunIdAttribute].StringValue)
+
+	return &Message{Message: *msg, Envelope: envelope, BodyDiscarded: true}, nil
+}
@@ -0,0 +1,191 @@
+package sqs
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Middleware wraps a Handler with cross-cutting behaviour
+type Middleware func(Handler) Handler
+
+// Chain wraps the handler with the middlewares. The first middleware is the
+// outermost one and sees the message first.
+func Chain(handler Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// Recover turns a panicking handler into a failed message instead of
+// crashing the process
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, mc *MessageContext) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					cErr.Printf("Handler panicked on message %s: %v \n%s \n", *mc.Message.MessageId, r, debug.Stack())
+					err = fmt.Errorf("handler panicked: %v", r)
+				}
+			}()
+
+			return next(ctx, mc)
+		}
+	}
+}
+
+// Timeout cancels the context passed to the handler after the given duration.
+// The outcome of the handler is kept as is: a handler that succeeded past the
+// deadline has applied its changes, and retrying the message would apply them
+// twice.
+func Timeout(d time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, mc *MessageContext) error {
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+
+			return next(ctx, mc)
+		}
+	}
+}
+
+// Logging prints every message along with the outcome of its handler as
+// key=value pairs to the logger of the dependencies
+func Logging() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, mc *MessageContext) error {
+			start := time.Now()
+			err := next(ctx, mc)
+
+			msg := mc.Message
+
+			var fields []string
+			fields = append(fields, "message_id="+*msg.MessageId)
+			fields = append(fields, "queue="+mc.QueueURL)
+			fields = append(fields, fmt.Sprintf("receive_count=%d", mc.ReceiveCount))
+			fields = append(fields, fmt.Sprintf("schema_version=%d", msg.Envelope.SchemaVersion))
+			for _, name := range sortedAttributeNames(msg) {
+				if value := msg.MessageAttributes[name].StringValue; value != nil {
+					fields = append(fields, name+"="+*value)
+				}
+			}
+			fields = append(fields, "duration="+time.Since(start).String())
+
+			if err != nil {
+				fields = append(fields, fmt.Sprintf("error=%q", err.Error()))
+			} else {
+				fields = append(fields, "status=ok")
+			}
+			mc.Logger.Printf("Message: %s \n", msg.Envelope.Payload)
+			mc.Logger.Println(strings.Join(fields, " "))
+
+			return err
+		}
+	}
+}
+
+func sortedAttributeNames(msg *Message) []string {
+	names := make([]string, 0, len(msg.MessageAttributes))
+	for name := range msg.MessageAttributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HandlerMetrics counts handled messages. It is safe for concurrent use.
+type HandlerMetrics struct {
+	succeeded     atomic.Int64
+	failed        atomic.Int64
+	totalDuration atomic.Int64
+	maxDuration   atomic.Int64
+
+	queuesMu sync.Mutex
+	queues   map[string]int64
+}
+
+func (m *HandlerMetrics) observe(queueURL string, d time.Duration, err error) {
+	m.queuesMu.Lock()
+	if m.queues == nil {
+		m.queues = make(map[string]int64)
+	}
+	m.queues[queueURL]++
+	m.queuesMu.Unlock()
+
+	if err != nil {
+		m.failed.Add(1)
+	} else {
+		m.succeeded.Add(1)
+	}
+
+	m.totalDuration.Add(int64(d))
+	for {
+		current := m.maxDuration.Load()
+		if int64(d) <= current || m.maxDuration.CompareAndSwap(current, int64(d)) {
+			return
+		}
+	}
+}
+
+// String summarizes the metrics
+func (m *HandlerMetrics) String() string {
+	succeeded := m.succeeded.Load()
+	failed := m.failed.Load()
+
+	var avg time.Duration
+	if total := succeeded + failed; total > 0 {
+		avg = time.Duration(m.totalDuration.Load() / total)
+	}
+
+	summary := fmt.Sprintf("succeeded=%d failed=%d avg_duration=%s max_duration=%s",
+		succeeded, failed, avg, time.Duration(m.maxDuration.Load()))
+
+	// Per-queue counts are only interesting when several queues are polled
+	m.queuesMu.Lock()
+	defer m.queuesMu.Unlock()
+	if len(m.queues) > 1 {
+		urls := make([]string, 0, len(m.queues))
+		for url := range m.queues {
+			urls = append(urls, url)
+		}
+		sort.Strings(urls)
+		for _, url := range urls {
+			summary += fmt.Sprintf(" queue[%s]=%d", url, m.queues[url])
+		}
+	}
+	return summary
+}
+
+// Metrics records the outcome and duration of every handled message
+func Metrics(m *HandlerMetrics) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, mc *MessageContext) error {
+			start := time.Now()
+			err := next(ctx, mc)
+			m.observe(mc.QueueURL, time.Since(start), err)
+			return err
+		}
+	}
+}
+
+// ValidateAttributes rejects messages missing any of the given message
+// attributes. Rejected messages are quarantined without retries.
+func ValidateAttributes(names ...string) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, mc *MessageContext) error {
+			for _, name := range names {
+				attr, ok := mc.Message.MessageAttributes[name]
+				if !ok || attr.StringValue == nil || *attr.StringValue == "" {
+					return NewInvalidMessageError("missing %s attribute", name)
+				}
+			}
+			return next(ctx, mc)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package sqs
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	tracing "github.com/debojitroy/aws-queue-tasks-consume/internal/services/tracing"
+)
+
+// inflight is a received message waiting for or undergoing processing
+type inflight struct {
+	msg   types.Message
+	queue *queue
+	// batch identifies the ReceiveMessage call that returned the message
+	batch         uint64
+	stopHeartbeat func()
+}
+
+// dispatch hands a received message to the processors
+func (w *Worker) dispatch(item *inflight) {
+	if item.queue.fifo {
+		w.shardFor(item.queue.URL + "#" + messageGroupId(&item.msg)) <- item
+		return
+	}
+	w.buffer <- item
+}
+
+// tryReserve takes a buffer slot without blocking
+func (w *Worker) tryReserve() bool {
+	select {
+	case w.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// release returns n buffer slots, letting paused pollers resume
+func (w *Worker) release(n int) {
+	for range n {
+		<-w.slots
+	}
+}
+
+func (w *Worker) startProcessors(ctx context.Context, handler Handler) {
+	// Processors serve the shared buffer and, with FIFO queues, their own shard
+	for i := range w.Config.NumProcessors {
+		var shard chan *inflight
+		if len(w.shards) > 0 {
+			shard = w.shards[i]
+		}
+
+		w.processors.Add(1)
+		go w.process(ctx, w.buffer, shard, handler)
+	}
+}
+
+// process handles messages from the buffer and shard until both are closed
+func (w *Worker) process(ctx context.Context, buffer <-chan *inflight, shard <-chan *inflight, handler Handler) {
+	defer w.processors.Done()
+
+	// FIFO queues: message group -> batch in which a message of that group failed
+	failedGroups := make(map[string]uint64)
+
+	for buffer != nil || shard != nil {
+		var item *inflight
+		var ok bool
+
+		select {
+		case item, ok = <-buffer:
+			if !ok {
+				buffer = nil
+				continue
+			}
+		case item, ok = <-shard:
+			if !ok {
+				shard = nil
+				continue
+			}
+		}
+
+		if w.draining.Load() || ctx.Err() != nil {
+			// Shutting down, hand the unstarted message back to the queue
+			item.stopHeartbeat()
+			w.releaseVisibility(context.WithoutCancel(ctx), item)
+			w.release(1)
+			continue
+		}
+
+		if !item.queue.fifo {
+			w.handle(ctx, item, handler)
+			w.release(1)
+			continue
+		}
+
+		// A failed message blocks the rest of its group in the same batch, so
+		// that it is retried before the messages that follow it
+		group := item.queue.URL + "#" + messageGroupId(&item.msg)
+		if batch, ok := failedGroups[group]; ok {
+			if batch == item.batch {
+				item.stopHeartbeat()
+				w.releaseVisibility(ctx, item)
+				w.release(1)
+				continue
+			}
+			delete(failedGroups, group)
+		}
+
+		if !w.handle(ctx, item, handler) {
+			failedGroups[group] = item.batch
+		}
+		w.release(1)
+	}
+}
+
+// releaseVisibility makes the message visible again right away
+func (w *Worker) releaseVisibility(ctx context.Context, item *inflight) {
+	_, err := w.Sqs.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          &item.queue.URL,
+		ReceiptHandle:     item.msg.ReceiptHandle,
+		VisibilityTimeout: 0,
+	})
+	if err != nil {
+		cErr.Printf("Error releasing message %s: %v \n", *item.msg.MessageId, err)
+	}
+}
+
+// handle runs the handler for a single message and acknowledges or
+// quarantines it depending on the outcome. It returns false if the message
+// was left on the queue for a retry.
+func (w *Worker) handle(ctx context.Context, item *inflight, handler Handler) bool {
+	message := &item.msg
+
+	// Quarantine messages that were already received too often
+	if reason, ok := w.quarantineReason(message, nil); ok {
+		item.stopHeartbeat()
+		return w.quarantine(ctx, item, reason)
+	}
+
+	ctx, span := startProcessSpan(ctx, message, item.queue.URL)
+	defer span.End()
+
+	// Resolve claim-checked bodies, keeping the pointer for the dead-letter
+	// queue, and decode the envelope. Claim checks whose blob is gone are
+	// left to the handler to tell duplicates apart.
+	var decoded *Message
+	resolved, blobKey, err := w.checkOut(ctx, message)
+	switch {
+	case err == nil:
+		decoded, err = decode(resolved)
+	case errors.Is(err, errClaimCheckDiscarded):
+		c.Printf("Body of message %s is gone: %v \n", *message.MessageId, err)
+		decoded, err = decodeDiscarded(message)
+	}
+	if err == nil {
+		err = handler(ctx, &MessageContext{
+			Dependencies: w.deps,
+			Message:      decoded,
+			ReceiveCount: receiveCount(message),
+			QueueURL:     item.queue.URL,
+		})
+	}
+	item.stopHeartbeat()
+
+	if err != nil {
+		cErr.Printf("Error processing message: %v \n", err)
+		tracing.RecordError(span, err)
+
+		if reason, ok := w.quarantineReason(message, err); ok {
+			return w.quarantine(ctx, item, reason)
+		}
+		return false
+	}
+
+	// Delete message after successful processing
+	if blobKey != "" {
+		item.queue.acker.ackThen(message, func() { w.discardBlob(blobKey) })
+	} else {
+		item.queue.acker.ack(message)
+	}
+	return true
+}
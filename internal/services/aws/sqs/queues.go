@@ -0,0 +1,211 @@
+package sqs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// PollStrategy decides which queue a poller receives from next
+type PollStrategy string
+
+const (
+	// PollWeighted polls queues in a random order biased by their weights
+	PollWeighted PollStrategy = "weighted"
+	// PollStrictPriority always polls higher priority queues first
+	PollStrictPriority PollStrategy = "strict"
+)
+
+// QueueConfig describes one of the queues polled by a worker
+type QueueConfig struct {
+	URL string
+	// Weight is the relative share of polls under PollWeighted. Defaults to 1.
+	Weight int
+	// Priority orders queues under PollStrictPriority, highest first
+	Priority int
+}
+
+// queue is a polled queue along with its receive input and acknowledger
+type queue struct {
+	QueueConfig
+	fifo  bool
+	input *sqs.ReceiveMessageInput
+	acker *acknowledger
+
+	// receiveErrors counts the failed receives from the queue
+	receiveErrors atomic.Int64
+}
+
+// ParseQueueConfigs parses a comma separated list of "url" or "url=weight"
+// entries. Queues listed first get the highest priority.
+func ParseQueueConfigs(spec string) ([]QueueConfig, error) {
+	var queues []QueueConfig
+
+	entries := strings.Split(spec, ",")
+	for i, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		q := QueueConfig{URL: entry, Weight: 1, Priority: len(entries) - i}
+		if url, weight, ok := strings.Cut(entry, "="); ok {
+			w, err := strconv.Atoi(weight)
+			if err != nil || w <= 0 {
+				return nil, fmt.Errorf("invalid weight %q for queue %s", weight, url)
+			}
+			q.URL = url
+			q.Weight = w
+		}
+		queues = append(queues, q)
+	}
+	return queues, nil
+}
+
+// queueConfigs returns the configured queues, falling back to QueueURL
+func (cfg *Config) queueConfigs() ([]QueueConfig, error) {
+	switch cfg.PollStrategy {
+	case "", PollWeighted, PollStrictPriority:
+	default:
+		return nil, fmt.Errorf("unknown poll strategy %q", cfg.PollStrategy)
+	}
+
+	if len(cfg.Queues) == 0 {
+		if cfg.QueueURL == "" {
+			return nil, fmt.Errorf("a queue URL is required")
+		}
+		return []QueueConfig{{URL: cfg.QueueURL, Weight: 1}}, nil
+	}
+
+	queues := make([]QueueConfig, len(cfg.Queues))
+	seen := make(map[string]struct{}, len(cfg.Queues))
+	for i, q := range cfg.Queues {
+		if q.URL == "" {
+			return nil, fmt.Errorf("queue %d has no URL", i)
+		}
+		if _, ok := seen[q.URL]; ok {
+			return nil, fmt.Errorf("queue %s is configured twice", q.URL)
+		}
+		seen[q.URL] = struct{}{}
+
+		if q.Weight <= 0 {
+			q.Weight = 1
+		}
+		queues[i] = q
+	}
+	return queues, nil
+}
+
+// pollOrder returns the queues in the order a poller should try them
+func (w *Worker) pollOrder() []*queue {
+	if len(w.queues) == 1 {
+		return w.queues
+	}
+
+	order := make([]*queue, len(w.queues))
+	copy(order, w.queues)
+
+	if w.Config.PollStrategy == PollStrictPriority {
+		sort.SliceStable(order, func(i, j int) bool {
+			return order[i].Priority > order[j].Priority
+		})
+		return order
+	}
+
+	// Weighted sampling without replacement
+	for i := range order {
+		total := 0
+		for _, q := range order[i:] {
+			total += q.Weight
+		}
+
+		pick := rand.Intn(total)
+		for j := i; j < len(order); j++ {
+			pick -= order[j].Weight
+			if pick < 0 {
+				order[i], order[j] = order[j], order[i]
+				break
+			}
+		}
+	}
+	return order
+}
+
+// receive tries the queues in poll order and returns the first non-empty
+// batch. All but the last queue are short-polled, so that a busy queue is
+// never starved by a long poll on an empty one. A queue failing to receive is
+// skipped, and an error is only returned when every queue failed.
+func (w *Worker) receive(ctx context.Context, maxMessages int32) (*queue, *sqs.ReceiveMessageOutput, error) {
+	order := w.pollOrder()
+	if len(order) == 0 {
+		return nil, nil, fmt.Errorf("no queues configured")
+	}
+
+	var errs []error
+	var answered *queue
+	for i, q := range order {
+		last := i == len(order)-1
+
+		output, err := w.receiveFrom(ctx, q, maxMessages, last)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if len(output.Messages) > 0 || last {
+			return q, output, nil
+		}
+		answered = q
+	}
+
+	if answered == nil {
+		return nil, nil, errors.Join(errs...)
+	}
+
+	// The queue meant to be long-polled failed, long-poll the last queue
+	// that answered instead of returning to the pollers right away
+	output, err := w.receiveFrom(ctx, answered, maxMessages, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	return answered, output, nil
+}
+
+// receiveFrom receives from a single queue, long-polling it if asked to, and
+// records failures against the queue
+func (w *Worker) receiveFrom(ctx context.Context, q *queue, maxMessages int32, longPoll bool) (*sqs.ReceiveMessageOutput, error) {
+	input := *q.input
+	input.MaxNumberOfMessages = maxMessages
+	if !longPoll {
+		input.WaitTimeSeconds = 0
+	}
+
+	output, err := w.Sqs.ReceiveMessage(ctx, &input)
+	if err != nil {
+		q.receiveErrors.Add(1)
+		if len(w.queues) > 1 && ctx.Err() == nil {
+			cErr.Printf("Error receiving from %s: %v \n", q.URL, err)
+		}
+		return nil, fmt.Errorf("receiving from %s: %w", q.URL, err)
+	}
+	return output, nil
+}
+
+// ReceiveErrorCounts returns the number of failed receives per queue URL,
+// leaving out queues that never failed
+func (w *Worker) ReceiveErrorCounts() map[string]int {
+	counts := make(map[string]int)
+	for _, q := range w.queues {
+		if n := q.receiveErrors.Load(); n > 0 {
+			counts[q.URL] = int(n)
+		}
+	}
+	return counts
+}
@@ -0,0 +1,118 @@
+package sqs
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// MessageTypeAttribute names the kind of task a message carries
+const MessageTypeAttribute = "message_type"
+
+// UnknownTypePolicy decides what happens to messages no handler is
+// registered for
+type UnknownTypePolicy string
+
+const (
+	// UnknownTypeDeadLetter quarantines the message right away
+	UnknownTypeDeadLetter UnknownTypePolicy = "dlq"
+	// UnknownTypeDrop deletes the message without processing it
+	UnknownTypeDrop UnknownTypePolicy = "drop"
+	// UnknownTypeRetry leaves the message on the queue, e.g. for a newer
+	// consumer that knows the type, until MaxReceiveCount is reached
+	UnknownTypeRetry UnknownTypePolicy = "retry"
+)
+
+// UnknownTypePolicyByName returns the policy with the given name
+func UnknownTypePolicyByName(name string) (UnknownTypePolicy, error) {
+	switch policy := UnknownTypePolicy(name); policy {
+	case UnknownTypeDeadLetter, UnknownTypeDrop, UnknownTypeRetry:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown message type policy %q", name)
+	}
+}
+
+// MessageType returns the type of the message, taken from the message_type
+// attribute or else from the envelope
+func MessageType(msg *Message) string {
+	if attr, ok := msg.MessageAttributes[MessageTypeAttribute]; ok && aws.ToString(attr.StringValue) != "" {
+		return *attr.StringValue
+	}
+	if msg.Envelope != nil {
+		return msg.Envelope.MessageType
+	}
+	return ""
+}
+
+// Router dispatches messages to the handler registered for their type
+type Router struct {
+	handlers map[string]Handler
+	fallback Handler
+	unknown  UnknownTypePolicy
+
+	droppedMu sync.Mutex
+	dropped   map[string]int
+}
+
+// NewRouter creates a router applying the given policy to messages of
+// unregistered types when no fallback handler is set
+func NewRouter(unknown UnknownTypePolicy) *Router {
+	return &Router{
+		handlers: make(map[string]Handler),
+		unknown:  unknown,
+		dropped:  make(map[string]int),
+	}
+}
+
+// Handle registers the handler for a message type
+func (r *Router) Handle(messageType string, handler Handler, middlewares ...Middleware) *Router {
+	r.handlers[messageType] = Chain(handler, middlewares...)
+	return r
+}
+
+// Fallback registers the handler for messages of unregistered types
+func (r *Router) Fallback(handler Handler) *Router {
+	r.fallback = handler
+	return r
+}
+
+// Handler returns the handler to pass to the consumer. Routes must not be
+// registered once the consumer is running.
+func (r *Router) Handler() Handler {
+	return func(ctx context.Context, mc *MessageContext) error {
+		messageType := MessageType(mc.Message)
+
+		if handler, ok := r.handlers[messageType]; ok {
+			return handler(ctx, mc)
+		}
+		if r.fallback != nil {
+			return r.fallback(ctx, mc)
+		}
+
+		switch r.unknown {
+		case UnknownTypeDrop:
+			r.droppedMu.Lock()
+			r.dropped[messageType]++
+			r.droppedMu.Unlock()
+
+			cErr.Printf("Dropping message %s of unknown type %q \n", aws.ToString(mc.Message.MessageId), messageType)
+			return nil
+		case UnknownTypeRetry:
+			return fmt.Errorf("no handler for message type %q", messageType)
+		default:
+			return NewInvalidMessageError("no handler for message type %q", messageType)
+		}
+	}
+}
+
+// DroppedCounts returns the number of dropped messages per message type
+func (r *Router) DroppedCounts() map[string]int {
+	r.droppedMu.Lock()
+	defer r.droppedMu.Unlock()
+
+	return maps.Clone(r.dropped)
+}
@@ -3,20 +3,41 @@ package sqs
 import (
 	"context"
 	"fmt"
-	"log"
 	"strconv"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
-	"github.com/aws/aws-sdk-go-v2/aws"
+	blobstore "github.com/debojitroy/aws-queue-tasks-consume/internal/services/blobstore"
 	entity "github.com/debojitroy/aws-queue-tasks-consume/internal/services/entity"
+	message "github.com/debojitroy/aws-queue-tasks-consume/internal/services/message"
+	scheduler "github.com/debojitroy/aws-queue-tasks-consume/internal/services/scheduler"
+	tracing "github.com/debojitroy/aws-queue-tasks-consume/internal/services/tracing"
 	color "github.com/fatih/color"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Message attributes identifying the entity message
+const (
+	RunIdAttribute     = "run_id"
+	EntityIdAttribute  = "entity_id"
+	MessageIdAttribute = "message_id"
 )
 
 type SqsClient struct {
 	client   *sqs.Client
 	queueUrl string
+	fifo     bool
+	codec    message.Codec
+	runId    string
+
+	claimCheckStore     blobstore.Store
+	claimCheckThreshold int
+
+	schedulerStore scheduler.Store
 }
 
 var cConsoleErr = color.New(color.FgRed).Add(color.Bold)
@@ -31,63 +52,245 @@ func NewSQSClient(region string, queueUrl string) (*SqsClient, error) {
 		return nil, err
 	}
 
+	// Trace every AWS call made with the config
+	tracing.InstrumentAWS(&cfg)
+
 	// Create SQS client
 	client := sqs.NewFromConfig(cfg)
 
 	return &SqsClient{
 		client:   client,
 		queueUrl: queueUrl,
+		fifo:     IsFifoQueue(queueUrl),
+		codec:    message.JSON,
 	}, nil
 }
 
-func (sqsClient *SqsClient) SendEntityMessages(entity *entity.Entity) error {
+// UseCodec sets the codec used to encode message envelopes. Defaults to JSON.
+func (sqsClient *SqsClient) UseCodec(codec message.Codec) {
+	sqsClient.codec = codec
+}
+
+// SetRunId sets the run identifier stamped on every message envelope and
+// run_id attribute
+func (sqsClient *SqsClient) SetRunId(runId string) {
+	sqsClient.runId = runId
+}
+
+// Retry policy for entries SendMessageBatch reports as failed
+const (
+	maxSendRetries     = 3
+	sendRetryBaseDelay = 200 * time.Millisecond
+	sendRetryMaxDelay  = 5 * time.Second
+)
+
+// UnsentMessage describes a message that could not be queued
+type UnsentMessage struct {
+	MessageId   string
+	Code        string
+	Reason      string
+	SenderFault bool
+}
+
+// SendReport summarizes the messages queued for an entity. Scheduled
+// messages are enqueued later by the scheduler.
+type SendReport struct {
+	EntityId  string
+	Sent      int
+	Scheduled int
+	Unsent    []UnsentMessage
+}
+
+// SendEntityMessages queues all messages of the entity. Entries that fail
+// transiently are retried with backoff; the returned report lists the
+// messages that were permanently dropped. An error is returned, together
+// with the report so far, when sending cannot continue.
+func (sqsClient *SqsClient) SendEntityMessages(ctx context.Context, entity *entity.Entity) (*SendReport, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "sqs publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "aws_sqs"),
+			attribute.String("messaging.destination.name", sqsClient.queueUrl),
+			attribute.String("entity.id", entity.GetId()),
+		))
+	defer span.End()
+
+	report, err := sqsClient.sendEntityMessages(ctx, entity)
+	span.SetAttributes(
+		attribute.Int("messages.sent", report.Sent),
+		attribute.Int("messages.scheduled", report.Scheduled),
+		attribute.Int("messages.unsent", len(report.Unsent)),
+	)
+	tracing.RecordError(span, err)
+	return report, err
+}
+
+func (sqsClient *SqsClient) sendEntityMessages(ctx context.Context, entity *entity.Entity) (*SendReport, error) {
 	// Process messages in batches of 10 (SQS maximum batch size)
 	const batchSize = 10
 	messages := entity.GetMessages()
 
-	counter := 1
+	report := &SendReport{EntityId: entity.GetId()}
 
-	for i := 0; i < entity.GetMessageCount(); i += batchSize {
-		end := i + batchSize
-		if end > entity.GetMessageCount() {
-			end = entity.GetMessageCount()
+	var entries []types.SendMessageBatchRequestEntry
+	for i, msg := range messages {
+		messageId := strconv.Itoa(i + 1)
+
+		envelope := message.NewEnvelope(sqsClient.runId, entity.GetId(), i+1, msg)
+		body, err := sqsClient.codec.Encode(envelope)
+		if err != nil {
+			return report, fmt.Errorf("failed to encode message %s: %w", messageId, err)
 		}
 
-		// Create batch entries for this chunk
-		var entries []types.SendMessageBatchRequestEntry
-		for j, msg := range messages[i:end] {
-			entries = append(entries, types.SendMessageBatchRequestEntry{
-				Id: aws.String(fmt.Sprintf("msg%d", i+j)),
-				MessageAttributes: map[string]types.MessageAttributeValue{
-					"entity_id":  {StringValue: aws.String(entity.GetId()), DataType: aws.String("String")},
-					"message_id": {StringValue: aws.String(strconv.Itoa(counter)), DataType: aws.String("String")},
-				},
-				MessageBody: aws.String(msg),
-			})
+		entry := types.SendMessageBatchRequestEntry{
+			Id: aws.String(fmt.Sprintf("msg%d", i)),
+			MessageAttributes: map[string]types.MessageAttributeValue{
+				EntityIdAttribute:    {StringValue: aws.String(entity.GetId()), DataType: aws.String("String")},
+				MessageIdAttribute:   {StringValue: aws.String(messageId), DataType: aws.String("String")},
+				ContentTypeAttribute: {StringValue: aws.String(sqsClient.codec.ContentType()), DataType: aws.String("String")},
+				MessageTypeAttribute: {StringValue: aws.String(envelope.MessageType), DataType: aws.String("String")},
+			},
+			MessageBody: aws.String(body),
+		}
 
-			counter++
+		if sqsClient.runId != "" {
+			entry.MessageAttributes[RunIdAttribute] = types.MessageAttributeValue{StringValue: aws.String(sqsClient.runId), DataType: aws.String("String")}
 		}
 
-		// Send the batch
-		input := &sqs.SendMessageBatchInput{
+		// Let consumers continue the trace of the producer
+		injectTraceContext(ctx, entry.MessageAttributes)
+
+		// Keep the messages of an entity in order on FIFO queues
+		if sqsClient.fifo {
+			entry.MessageGroupId = aws.String(entity.GetId())
+			entry.MessageDeduplicationId = aws.String(deduplicationId(entity.GetId(), messageId))
+		}
+
+		// Move oversized bodies to the blob store
+		if err := sqsClient.checkIn(ctx, claimCheckKey(&entry), &entry); err != nil {
+			return report, err
+		}
+
+		// Postpone delivery, either in SQS or through the scheduler
+		scheduled, err := sqsClient.delay(ctx, &entry, entity.GetMessageDelay(i))
+		if err != nil {
+			return report, err
+		}
+		if scheduled {
+			report.Scheduled++
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	for len(entries) > 0 {
+		// A batch is limited both in entries and in total size
+		end, size := 0, 0
+		for end < len(entries) && end < batchSize {
+			entrySize := messageSize(*entries[end].MessageBody, entries[end].MessageAttributes)
+			if end > 0 && size+entrySize > maxMessageBytes {
+				break
+			}
+			size += entrySize
+			end++
+		}
+
+		batch := entries[:end]
+		entries = entries[end:]
+
+		if err := sqsClient.sendBatch(ctx, batch, report); err != nil {
+			for _, entry := range entries {
+				sqsClient.drop(report, entry, UnsentMessage{Code: "NotAttempted", Reason: err.Error()})
+			}
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+// sendBatch sends the entries, retrying those that failed transiently, and
+// records the outcome in the report
+func (sqsClient *SqsClient) sendBatch(ctx context.Context, entries []types.SendMessageBatchRequestEntry, report *SendReport) error {
+	b := newBackoff(sendRetryBaseDelay, sendRetryMaxDelay)
+
+	for attempt := 0; ; attempt++ {
+		result, err := sqsClient.client.SendMessageBatch(ctx, &sqs.SendMessageBatchInput{
 			QueueUrl: &sqsClient.queueUrl,
 			Entries:  entries,
+		})
+		if err != nil {
+			cConsoleErr.Printf("Failed to send batch: %v \n", err)
+
+			if !isRetryable(err) || attempt >= maxSendRetries {
+				for _, entry := range entries {
+					sqsClient.drop(report, entry, UnsentMessage{Code: "RequestFailed", Reason: err.Error()})
+				}
+				return fmt.Errorf("failed to send batch: %w", err)
+			}
+
+			if !b.wait(ctx, nil) {
+				return sqsClient.cancelled(ctx, entries, report)
+			}
+			continue
 		}
 
-		result, err := sqsClient.client.SendMessageBatch(context.TODO(), input)
-		if err != nil {
-			log.Fatalf("failed to send batch due to error: %s", err.Error())
-			log.Fatalf("failed to send batch: %v", err)
-			return err
+		report.Sent += len(result.Successful)
+
+		byId := make(map[string]types.SendMessageBatchRequestEntry, len(entries))
+		for _, entry := range entries {
+			byId[*entry.Id] = entry
 		}
 
-		// Handle any failed messages
-		if len(result.Failed) > 0 {
-			for _, failure := range result.Failed {
-				cConsoleErr.Printf("Failed to send message ID: %s, Code: %s, Message: %s\n",
-					*failure.Id, *failure.Code, *failure.Message)
+		var retry []types.SendMessageBatchRequestEntry
+		for _, failure := range result.Failed {
+			cConsoleErr.Printf("Failed to send message ID: %s, Code: %s, Message: %s\n",
+				aws.ToString(failure.Id), aws.ToString(failure.Code), aws.ToString(failure.Message))
+
+			entry := byId[aws.ToString(failure.Id)]
+			if !failure.SenderFault && attempt < maxSendRetries {
+				retry = append(retry, entry)
+				continue
 			}
+
+			// Sender faults (e.g. an invalid attribute) will not succeed on retry
+			sqsClient.drop(report, entry, UnsentMessage{
+				Code:        aws.ToString(failure.Code),
+				Reason:      aws.ToString(failure.Message),
+				SenderFault: failure.SenderFault,
+			})
+		}
+
+		if len(retry) == 0 {
+			return nil
+		}
+
+		entries = retry
+		if !b.wait(ctx, nil) {
+			return sqsClient.cancelled(ctx, entries, report)
+		}
+	}
+}
+
+// cancelled records the entries still to be retried as unsent once ctx is
+// done
+func (sqsClient *SqsClient) cancelled(ctx context.Context, entries []types.SendMessageBatchRequestEntry, report *SendReport) error {
+	for _, entry := range entries {
+		sqsClient.drop(report, entry, UnsentMessage{Code: "Cancelled", Reason: ctx.Err().Error()})
+	}
+	return fmt.Errorf("sending batch cancelled: %w", ctx.Err())
+}
+
+// drop records a message as permanently unsent and discards its claim-checked
+// body, if any
+func (sqsClient *SqsClient) drop(report *SendReport, entry types.SendMessageBatchRequestEntry, unsent UnsentMessage) {
+	unsent.MessageId = aws.ToString(entry.MessageAttributes[MessageIdAttribute].StringValue)
+	report.Unsent = append(report.Unsent, unsent)
+
+	if _, ok := entry.MessageAttributes[ClaimCheckAttribute]; ok {
+		if err := sqsClient.claimCheckStore.Delete(context.TODO(), claimCheckKey(&entry)); err != nil {
+			cConsoleErr.Printf("Failed to delete claim-checked body of message %s: %v \n", unsent.MessageId, err)
 		}
 	}
-	return nil
 }
@@ -0,0 +1,53 @@
+package sqs
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	tracing "github.com/debojitroy/aws-queue-tasks-consume/internal/services/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// attributeCarrier exposes message attributes to the trace context
+// propagator. Only traceparent (and tracestate, when set) are written, to
+// stay well within the 10 attributes SQS allows per message.
+type attributeCarrier map[string]types.MessageAttributeValue
+
+func (a attributeCarrier) Get(key string) string {
+	return aws.ToString(a[key].StringValue)
+}
+
+func (a attributeCarrier) Set(key string, value string) {
+	a[key] = types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(value)}
+}
+
+func (a attributeCarrier) Keys() []string {
+	keys := make([]string, 0, len(a))
+	for key := range a {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// injectTraceContext adds the trace context of ctx to the message attributes
+func injectTraceContext(ctx context.Context, attributes map[string]types.MessageAttributeValue) {
+	tracing.Propagator.Inject(ctx, attributeCarrier(attributes))
+}
+
+// startProcessSpan starts the consumer span of a received message, continuing
+// the trace of the producer
+func startProcessSpan(ctx context.Context, msg *types.Message, queueURL string) (context.Context, trace.Span) {
+	ctx = tracing.Propagator.Extract(ctx, attributeCarrier(msg.MessageAttributes))
+
+	return tracing.Tracer().Start(ctx, "sqs process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "aws_sqs"),
+			attribute.String("messaging.destination.name", queueURL),
+			attribute.String("messaging.message.id", aws.ToString(msg.MessageId)),
+			attribute.String("entity.id", aws.ToString(msg.MessageAttributes[EntityIdAttribute].StringValue)),
+			attribute.Int("messaging.sqs.receive_count", receiveCount(msg)),
+		))
+}
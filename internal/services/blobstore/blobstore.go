@@ -0,0 +1,21 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrNotFound is returned when a blob does not exist
+var ErrNotFound = errors.New("blob not found")
+
+// Store keeps message bodies that are too large to travel through SQS
+type Store interface {
+	// Name identifies the kind of store in claim-check pointers
+	Name() string
+	// Location identifies where the store keeps its blobs, e.g. the bucket
+	// and prefix, so that a pointer is only resolved against the same store
+	Location() string
+	Put(ctx context.Context, key string, data []byte) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	Delete(ctx context.Context, key string) error
+}
@@ -24,6 +24,11 @@ type Entity struct {
 	id           string
 	messageCount int
 	messages     []string
+
+	// delay postpones delivery of all messages, messageDelays postpones
+	// single messages on top of it
+	delay         time.Duration
+	messageDelays map[int]time.Duration
 }
 
 func AddEntity(entityId string) {
@@ -66,3 +71,22 @@ func (e *Entity) GetMessageCount() int {
 func (e *Entity) GetMessages() []string {
 	return e.messages
 }
+
+// SetDelay postpones the delivery of all messages of the entity
+func (e *Entity) SetDelay(delay time.Duration) {
+	e.delay = delay
+}
+
+// SetMessageDelay postpones the delivery of the message at index i, on top
+// of the entity delay
+func (e *Entity) SetMessageDelay(i int, delay time.Duration) {
+	if e.messageDelays == nil {
+		e.messageDelays = make(map[int]time.Duration)
+	}
+	e.messageDelays[i] = delay
+}
+
+// GetMessageDelay returns the total delivery delay of the message at index i
+func (e *Entity) GetMessageDelay(i int) time.Duration {
+	return e.delay + e.messageDelays[i]
+}
@@ -0,0 +1,83 @@
+package ledger
+
+import (
+	"context"
+	"sync"
+
+	dynamodb "github.com/debojitroy/aws-queue-tasks-consume/internal/services/aws/dynamodb"
+)
+
+// Ledger decrements the message count of an entity at most once per message,
+// so that redelivered messages do not drive the count below its true value
+type Ledger interface {
+	// Consume records the message as processed and decrements the message
+	// count of its entity. It returns false, without decrementing, if the
+	// message was processed before.
+	Consume(ctx context.Context, runId string, entityId string, messageId string) (bool, error)
+	// Processed reports whether the message was consumed before
+	Processed(ctx context.Context, runId string, entityId string, messageId string) (bool, error)
+}
+
+// MemoryLedger is an in-memory Ledger for tests and local runs. It fails with
+// the same errors as the DynamoDB ledger and is safe for concurrent use.
+type MemoryLedger struct {
+	mu        sync.Mutex
+	counts    map[string]int
+	processed map[string]struct{}
+}
+
+func NewMemoryLedger() *MemoryLedger {
+	return &MemoryLedger{
+		counts:    make(map[string]int),
+		processed: make(map[string]struct{}),
+	}
+}
+
+// SetCount sets the message count of the entity
+func (m *MemoryLedger) SetCount(runId string, entityId string, count int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.counts[runId+"#"+entityId] = count
+}
+
+// Count returns the message count of the entity
+func (m *MemoryLedger) Count(runId string, entityId string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.counts[runId+"#"+entityId]
+}
+
+func (m *MemoryLedger) Consume(ctx context.Context, runId string, entityId string, messageId string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entityKey := runId + "#" + entityId
+	key := entityKey + "#" + messageId
+	if _, ok := m.processed[key]; ok {
+		return false, nil
+	}
+
+	count, ok := m.counts[entityKey]
+	if !ok {
+		return false, &dynamodb.NotFoundError{RunId: runId, EntityId: entityId}
+	}
+	// Like the transaction of the DynamoDB ledger, a failed decrement does
+	// not record the message
+	if count < 1 {
+		return false, &dynamodb.UnderflowError{EntityId: entityId, MessageCount: count, Decrement: 1}
+	}
+
+	m.processed[key] = struct{}{}
+	m.counts[entityKey]--
+	return true, nil
+}
+
+func (m *MemoryLedger) Processed(ctx context.Context, runId string, entityId string, messageId string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.processed[runId+"#"+entityId+"#"+messageId]
+	return ok, nil
+}
@@ -0,0 +1,82 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	dynamodb "github.com/debojitroy/aws-queue-tasks-consume/internal/services/aws/dynamodb"
+)
+
+func TestMemoryLedgerConsumeIsIdempotent(t *testing.T) {
+	ctx := context.Background()
+	l := NewMemoryLedger()
+	l.SetCount("run", "entity", 3)
+
+	applied, err := l.Consume(ctx, "run", "entity", "1")
+	if err != nil || !applied {
+		t.Fatalf("first Consume = %v, %v, want true, nil", applied, err)
+	}
+
+	applied, err = l.Consume(ctx, "run", "entity", "1")
+	if err != nil || applied {
+		t.Fatalf("repeated Consume = %v, %v, want false, nil", applied, err)
+	}
+
+	if count := l.Count("run", "entity"); count != 2 {
+		t.Fatalf("Count = %d, want 2", count)
+	}
+}
+
+func TestMemoryLedgerScopesMessagesByRun(t *testing.T) {
+	ctx := context.Background()
+	l := NewMemoryLedger()
+	l.SetCount("run-a", "entity", 1)
+	l.SetCount("run-b", "entity", 1)
+
+	for _, runId := range []string{"run-a", "run-b"} {
+		applied, err := l.Consume(ctx, runId, "entity", "1")
+		if err != nil || !applied {
+			t.Fatalf("Consume in %s = %v, %v, want true, nil", runId, applied, err)
+		}
+	}
+}
+
+func TestMemoryLedgerUnknownEntity(t *testing.T) {
+	l := NewMemoryLedger()
+
+	_, err := l.Consume(context.Background(), "run", "entity", "1")
+
+	var notFound *dynamodb.NotFoundError
+	if !errors.As(err, &notFound) {
+		t.Fatalf("Consume error = %v, want a NotFoundError", err)
+	}
+}
+
+func TestMemoryLedgerRefusesToUnderflow(t *testing.T) {
+	ctx := context.Background()
+	l := NewMemoryLedger()
+	l.SetCount("run", "entity", 1)
+
+	if _, err := l.Consume(ctx, "run", "entity", "1"); err != nil {
+		t.Fatalf("Consume: %v", err)
+	}
+
+	_, err := l.Consume(ctx, "run", "entity", "2")
+
+	var underflow *dynamodb.UnderflowError
+	if !errors.As(err, &underflow) {
+		t.Fatalf("Consume error = %v, want an UnderflowError", err)
+	}
+	if count := l.Count("run", "entity"); count != 0 {
+		t.Fatalf("Count = %d, want 0", count)
+	}
+
+	// The failed message was not recorded, so it is counted once the count
+	// allows it
+	l.SetCount("run", "entity", 1)
+	applied, err := l.Consume(ctx, "run", "entity", "2")
+	if err != nil || !applied {
+		t.Fatalf("Consume after raising the count = %v, %v, want true, nil", applied, err)
+	}
+}
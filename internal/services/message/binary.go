@@ -0,0 +1,115 @@
+package message
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Field numbers of the binary encoding. Numbers must never be reused, so
+// that older decoders can skip fields they do not know.
+const (
+	fieldSchemaVersion = 1
+	fieldEntityId      = 2
+	fieldSequence      = 3
+	fieldRunId         = 4
+	fieldCreatedAt     = 5
+	fieldPayload       = 6
+	fieldMessageType   = 7
+)
+
+// Wire types, as in protocol buffers
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+// binaryCodec encodes envelopes as protobuf-style tagged fields
+type binaryCodec struct{}
+
+func (binaryCodec) ContentType() string {
+	return ContentTypeBinary
+}
+
+func appendVarint(buf []byte, field int, value uint64) []byte {
+	buf = binary.AppendUvarint(buf, uint64(field)<<3|wireVarint)
+	return binary.AppendUvarint(buf, value)
+}
+
+func appendBytes(buf []byte, field int, value string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(field)<<3|wireBytes)
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+func (binaryCodec) Encode(envelope *Envelope) (string, error) {
+	var buf []byte
+	buf = appendVarint(buf, fieldSchemaVersion, uint64(envelope.SchemaVersion))
+	buf = appendBytes(buf, fieldEntityId, envelope.EntityId)
+	buf = appendVarint(buf, fieldSequence, uint64(envelope.Sequence))
+	buf = appendBytes(buf, fieldRunId, envelope.RunId)
+	buf = appendVarint(buf, fieldCreatedAt, uint64(envelope.CreatedAt.UnixNano()))
+	buf = appendBytes(buf, fieldPayload, envelope.Payload)
+	buf = appendBytes(buf, fieldMessageType, envelope.MessageType)
+
+	return base64.StdEncoding.EncodeToString(buf), nil
+}
+
+func (binaryCodec) Decode(body string) (*Envelope, error) {
+	buf, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := new(Envelope)
+	for len(buf) > 0 {
+		key, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, fmt.Errorf("malformed field key")
+		}
+		buf = buf[n:]
+
+		field, wireType := int(key>>3), key&7
+
+		switch wireType {
+		case wireVarint:
+			value, n := binary.Uvarint(buf)
+			if n <= 0 {
+				return nil, fmt.Errorf("malformed varint in field %d", field)
+			}
+			buf = buf[n:]
+
+			switch field {
+			case fieldSchemaVersion:
+				envelope.SchemaVersion = int(value)
+			case fieldSequence:
+				envelope.Sequence = int(value)
+			case fieldCreatedAt:
+				envelope.CreatedAt = time.Unix(0, int64(value)).UTC()
+			}
+		case wireBytes:
+			length, n := binary.Uvarint(buf)
+			if n <= 0 || uint64(len(buf)-n) < length {
+				return nil, fmt.Errorf("malformed length in field %d", field)
+			}
+			value := string(buf[n : n+int(length)])
+			buf = buf[n+int(length):]
+
+			switch field {
+			case fieldEntityId:
+				envelope.EntityId = value
+			case fieldRunId:
+				envelope.RunId = value
+			case fieldPayload:
+				envelope.Payload = value
+			case fieldMessageType:
+				envelope.MessageType = value
+			}
+		default:
+			return nil, fmt.Errorf("unsupported wire type %d in field %d", wireType, field)
+		}
+	}
+
+	return envelope, envelope.validate()
+}
@@ -0,0 +1,126 @@
+package message
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Content types identifying the codec in the content_type message attribute
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeBinary   = "application/x-protobuf"
+	ContentTypeGzipJSON = "application/json+gzip"
+)
+
+// Codec turns envelopes into SQS message bodies and back. Bodies are text,
+// so binary encodings are base64 encoded.
+type Codec interface {
+	ContentType() string
+	Encode(envelope *Envelope) (string, error)
+	Decode(body string) (*Envelope, error)
+}
+
+var (
+	JSON     Codec = jsonCodec{}
+	Binary   Codec = binaryCodec{}
+	GzipJSON Codec = gzipJSONCodec{}
+)
+
+var codecs = map[string]Codec{
+	ContentTypeJSON:     JSON,
+	ContentTypeBinary:   Binary,
+	ContentTypeGzipJSON: GzipJSON,
+}
+
+// CodecFor returns the codec for the content type
+func CodecFor(contentType string) (Codec, error) {
+	codec, ok := codecs[contentType]
+	if !ok {
+		return nil, fmt.Errorf("unknown content type %q", contentType)
+	}
+	return codec, nil
+}
+
+// CodecByName returns a codec by its short name: json, binary or gzip-json
+func CodecByName(name string) (Codec, error) {
+	switch name {
+	case "json":
+		return JSON, nil
+	case "binary":
+		return Binary, nil
+	case "gzip-json":
+		return GzipJSON, nil
+	default:
+		return nil, fmt.Errorf("unknown codec %q", name)
+	}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return ContentTypeJSON
+}
+
+func (jsonCodec) Encode(envelope *Envelope) (string, error) {
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func (jsonCodec) Decode(body string) (*Envelope, error) {
+	envelope := new(Envelope)
+	if err := json.Unmarshal([]byte(body), envelope); err != nil {
+		return nil, err
+	}
+	return envelope, envelope.validate()
+}
+
+type gzipJSONCodec struct{}
+
+func (gzipJSONCodec) ContentType() string {
+	return ContentTypeGzipJSON
+}
+
+func (gzipJSONCodec) Encode(envelope *Envelope) (string, error) {
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func (gzipJSONCodec) Decode(body string) (*Envelope, error) {
+	compressed, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		return nil, err
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+
+	return JSON.Decode(string(data))
+}
@@ -0,0 +1,68 @@
+package message
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// SchemaVersion is the version of the envelope written by this code.
+// Version 0 denotes legacy messages sent as a plain body with the identity
+// carried in message attributes only.
+const SchemaVersion = 1
+
+// EntityMessageType is the message type of the messages counted down per entity
+const EntityMessageType = "entity_message"
+
+// Envelope is the typed content of an entity message
+type Envelope struct {
+	SchemaVersion int       `json:"schema_version"`
+	MessageType   string    `json:"message_type,omitempty"`
+	EntityId      string    `json:"entity_id"`
+	Sequence      int       `json:"sequence"`
+	RunId         string    `json:"run_id,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	Payload       string    `json:"payload"`
+}
+
+// NewEnvelope creates an entity message envelope of the current schema version
+func NewEnvelope(runId string, entityId string, sequence int, payload string) *Envelope {
+	return &Envelope{
+		SchemaVersion: SchemaVersion,
+		MessageType:   EntityMessageType,
+		EntityId:      entityId,
+		Sequence:      sequence,
+		RunId:         runId,
+		CreatedAt:     time.Now().UTC(),
+		Payload:       payload,
+	}
+}
+
+// FromLegacy builds an envelope from a message sent before envelopes were
+// introduced, where the body is the payload and the identity is carried in
+// the entity_id and message_id attributes
+func FromLegacy(body string, entityId string, messageId string) (*Envelope, error) {
+	sequence, err := strconv.Atoi(messageId)
+	if err != nil {
+		return nil, fmt.Errorf("invalid legacy message id %q: %v", messageId, err)
+	}
+
+	return &Envelope{
+		SchemaVersion: 0,
+		MessageType:   EntityMessageType,
+		EntityId:      entityId,
+		Sequence:      sequence,
+		Payload:       body,
+	}, nil
+}
+
+// validate checks the envelope after decoding
+func (e *Envelope) validate() error {
+	if e.SchemaVersion < 1 || e.SchemaVersion > SchemaVersion {
+		return fmt.Errorf("unsupported schema version %d", e.SchemaVersion)
+	}
+	if e.EntityId == "" {
+		return fmt.Errorf("envelope has no entity id")
+	}
+	return nil
+}
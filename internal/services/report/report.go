@@ -0,0 +1,157 @@
+package report
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	dynamodb "github.com/debojitroy/aws-queue-tasks-consume/internal/services/aws/dynamodb"
+)
+
+// Output formats supported by Write
+const (
+	FormatTable = "table"
+	FormatJSON  = "json"
+	FormatCSV   = "csv"
+)
+
+// EntityStatus is the progress of a single entity
+type EntityStatus struct {
+	EntityId          string          `json:"entity_id"`
+	Status            dynamodb.Status `json:"status"`
+	RemainingMessages int             `json:"remaining_messages"`
+	LastUpdated       string          `json:"last_updated,omitempty"`
+	Stuck             bool            `json:"stuck"`
+}
+
+// Report is the progress of a run
+type Report struct {
+	RunId             string         `json:"run_id"`
+	GeneratedAt       time.Time      `json:"generated_at"`
+	Entities          int            `json:"entities"`
+	RemainingMessages int            `json:"remaining_messages"`
+	Completed         int            `json:"completed"`
+	Stuck             int            `json:"stuck"`
+	EntityStatuses    []EntityStatus `json:"entity_statuses"`
+}
+
+// Build summarizes the entities of a run. Unfinished entities not updated
+// for stuckAfter, not counting the time their messages were delayed, are
+// reported as stuck. Entities are ordered by remaining
+// messages, most first.
+func Build(runId string, entities []dynamodb.EntityMessages, stuckAfter time.Duration, now time.Time) *Report {
+	r := &Report{
+		RunId:          runId,
+		GeneratedAt:    now.UTC(),
+		Entities:       len(entities),
+		EntityStatuses: make([]EntityStatus, 0, len(entities)),
+	}
+
+	for _, e := range entities {
+		row := EntityStatus{
+			EntityId:          e.EntityId,
+			Status:            e.Status,
+			RemainingMessages: e.MessageCount,
+			LastUpdated:       e.LastUpdated,
+		}
+
+		r.RemainingMessages += e.MessageCount
+
+		if e.Status == dynamodb.StatusCompleted || (e.Status == "" && e.MessageCount == 0) {
+			r.Completed++
+		} else if !e.Status.IsTerminal() {
+			row.Stuck = isStuck(e, stuckAfter, now)
+		}
+		if row.Stuck {
+			r.Stuck++
+		}
+
+		r.EntityStatuses = append(r.EntityStatuses, row)
+	}
+
+	sort.SliceStable(r.EntityStatuses, func(i, j int) bool {
+		a, b := r.EntityStatuses[i], r.EntityStatuses[j]
+		if a.RemainingMessages != b.RemainingMessages {
+			return a.RemainingMessages > b.RemainingMessages
+		}
+		return a.EntityId < b.EntityId
+	})
+
+	return r
+}
+
+// isStuck reports whether the entity has not changed for stuckAfter. Entities
+// with delayed messages are given stuckAfter from when their last message
+// becomes deliverable.
+func isStuck(e dynamodb.EntityMessages, stuckAfter time.Duration, now time.Time) bool {
+	updated := e.LastUpdated
+	if updated == "" {
+		updated = e.CreatedAt
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, updated)
+	if err != nil {
+		return false
+	}
+
+	if deliverBy, err := time.Parse(time.RFC3339Nano, e.DeliverBy); err == nil && deliverBy.After(t) {
+		t = deliverBy
+	}
+	return now.Sub(t) > stuckAfter
+}
+
+// Write renders the report in the format
+func (r *Report) Write(w io.Writer, format string) error {
+	switch format {
+	case FormatTable:
+		return r.writeTable(w)
+	case FormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(r)
+	case FormatCSV:
+		return r.writeCSV(w)
+	default:
+		return fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+func (r *Report) writeTable(w io.Writer) error {
+	fmt.Fprintf(w, "Run %s at %s \n", r.RunId, r.GeneratedAt.Format(time.RFC3339))
+	fmt.Fprintf(w, "Entities: %d  Remaining messages: %d  Completed: %d  Stuck: %d \n\n",
+		r.Entities, r.RemainingMessages, r.Completed, r.Stuck)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ENTITY ID\tSTATUS\tREMAINING\tLAST UPDATED\tSTUCK")
+	for _, row := range r.EntityStatuses {
+		stuck := ""
+		if row.Stuck {
+			stuck = "yes"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", row.EntityId, row.Status, row.RemainingMessages, row.LastUpdated, stuck)
+	}
+	return tw.Flush()
+}
+
+// writeCSV writes one row per entity, the totals can be derived from them
+func (r *Report) writeCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"run_id", "entity_id", "status", "remaining_messages", "last_updated", "stuck"})
+	for _, row := range r.EntityStatuses {
+		writer.Write([]string{
+			r.RunId,
+			row.EntityId,
+			string(row.Status),
+			strconv.Itoa(row.RemainingMessages),
+			row.LastUpdated,
+			strconv.FormatBool(row.Stuck),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,88 @@
+package scheduler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FileStore keeps one JSON file per task in a directory, so that scheduled
+// tasks survive restarts
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore creates a store in dir, creating it if needed
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+// path maps a task id to a file name that is safe on any filesystem
+func (f *FileStore) path(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(f.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (f *FileStore) Add(ctx context.Context, task Task) error {
+	data, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so readers never see partial tasks
+	path := f.path(task.Id)
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (f *FileStore) Due(ctx context.Context, now time.Time) ([]Task, error) {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var due []Task
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(f.dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		var task Task
+		if err := json.Unmarshal(data, &task); err != nil {
+			cErr.Printf("Ignoring malformed task file %s: %v \n", entry.Name(), err)
+			continue
+		}
+
+		if !task.DueAt.After(now) {
+			due = append(due, task)
+		}
+	}
+
+	sortByDue(due)
+	return due, nil
+}
+
+func (f *FileStore) Remove(ctx context.Context, id string) error {
+	err := os.Remove(f.path(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
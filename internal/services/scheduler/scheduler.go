@@ -0,0 +1,145 @@
+package scheduler
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	color "github.com/fatih/color"
+)
+
+// Task is a message to be enqueued once it is due
+type Task struct {
+	Id              string            `json:"id"`
+	QueueUrl        string            `json:"queue_url"`
+	Body            string            `json:"body"`
+	Attributes      map[string]string `json:"attributes"`
+	GroupId         string            `json:"group_id,omitempty"`
+	DeduplicationId string            `json:"deduplication_id,omitempty"`
+	DueAt           time.Time         `json:"due_at"`
+}
+
+// Store keeps tasks until they are due
+type Store interface {
+	Add(ctx context.Context, task Task) error
+	// Due returns the tasks due at the given time, earliest first
+	Due(ctx context.Context, now time.Time) ([]Task, error)
+	Remove(ctx context.Context, id string) error
+}
+
+// Sender enqueues a due task
+type Sender interface {
+	SendTask(ctx context.Context, task Task) error
+}
+
+const defaultPollInterval = 10 * time.Second
+
+var c = color.New(color.FgHiMagenta)
+var cErr = color.New(color.FgRed).Add(color.Bold)
+
+// Scheduler enqueues stored tasks once they are due
+type Scheduler struct {
+	store    Store
+	sender   Sender
+	interval time.Duration
+}
+
+// NewScheduler creates a scheduler checking the store every interval.
+// A zero interval defaults to ten seconds.
+func NewScheduler(store Store, sender Sender, interval time.Duration) *Scheduler {
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	return &Scheduler{
+		store:    store,
+		sender:   sender,
+		interval: interval,
+	}
+}
+
+// Run enqueues due tasks until the context is cancelled
+func (s *Scheduler) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		s.enqueueDue(ctx)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// enqueueDue sends every due task and removes it from the store. Tasks that
+// fail to send stay in the store and are retried on the next tick.
+func (s *Scheduler) enqueueDue(ctx context.Context) {
+	tasks, err := s.store.Due(ctx, time.Now())
+	if err != nil {
+		cErr.Printf("Error reading due tasks: %v \n", err)
+		return
+	}
+
+	for _, task := range tasks {
+		if err := s.sender.SendTask(ctx, task); err != nil {
+			cErr.Printf("Error enqueueing scheduled task %s: %v \n", task.Id, err)
+			continue
+		}
+
+		if err := s.store.Remove(ctx, task.Id); err != nil {
+			cErr.Printf("Error removing scheduled task %s: %v \n", task.Id, err)
+			continue
+		}
+
+		c.Printf("Enqueued scheduled task %s due at %s \n", task.Id, task.DueAt.Format(time.RFC3339))
+	}
+}
+
+// MemoryStore keeps tasks in memory. Tasks are lost when the process exits.
+type MemoryStore struct {
+	mu    sync.Mutex
+	tasks map[string]Task
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{tasks: make(map[string]Task)}
+}
+
+func (m *MemoryStore) Add(ctx context.Context, task Task) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.tasks[task.Id] = task
+	return nil
+}
+
+func (m *MemoryStore) Due(ctx context.Context, now time.Time) ([]Task, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var due []Task
+	for _, task := range m.tasks {
+		if !task.DueAt.After(now) {
+			due = append(due, task)
+		}
+	}
+	sortByDue(due)
+	return due, nil
+}
+
+func (m *MemoryStore) Remove(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.tasks, id)
+	return nil
+}
+
+func sortByDue(tasks []Task) {
+	sort.SliceStable(tasks, func(i, j int) bool {
+		return tasks[i].DueAt.Before(tasks[j].DueAt)
+	})
+}
@@ -0,0 +1,128 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/aws/aws-sdk-go-v2/otelaws"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/debojitroy/aws-queue-tasks-consume"
+
+// Propagator carries W3C trace context across SQS messages and DynamoDB items
+var Propagator = propagation.TraceContext{}
+
+// Exporters supported by Setup
+const (
+	ExporterNone = "none"
+	ExporterOTLP = "otlp"
+	ExporterFile = "file"
+)
+
+// Config selects where spans are exported to
+type Config struct {
+	ServiceName string
+	// Exporter is one of ExporterNone, ExporterOTLP or ExporterFile
+	Exporter string
+	// Endpoint is the host:port of the OTLP/HTTP collector. Defaults to
+	// OTEL_EXPORTER_OTLP_ENDPOINT or localhost:4318.
+	Endpoint string
+	// File receives one JSON document per span with ExporterFile
+	File string
+}
+
+// Setup installs the global tracer provider and the W3C trace context
+// propagator. The returned function flushes pending spans and must be called
+// before the process exits.
+func Setup(ctx context.Context, cfg Config) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(Propagator)
+
+	var exporter sdktrace.SpanExporter
+	var file *os.File
+
+	switch cfg.Exporter {
+	case "", ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLP:
+		var opts []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint), otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	case ExporterFile:
+		if cfg.File == "" {
+			return nil, fmt.Errorf("a trace file is required for the %s exporter", ExporterFile)
+		}
+		file, err = os.Create(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(cfg.ServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		return err
+	}, nil
+}
+
+// Tracer returns the tracer used throughout the application
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// InstrumentAWS adds a span around every call made with clients created
+// from the config
+func InstrumentAWS(cfg *aws.Config) {
+	otelaws.AppendMiddlewares(&cfg.APIOptions)
+}
+
+// TraceParent returns the W3C traceparent of the span in ctx, or an empty
+// string if there is none
+func TraceParent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	Propagator.Inject(ctx, carrier)
+	return carrier.Get("traceparent")
+}
+
+// SpanContextFromTraceParent parses a W3C traceparent
+func SpanContextFromTraceParent(traceParent string) trace.SpanContext {
+	carrier := propagation.MapCarrier{"traceparent": traceParent}
+	ctx := Propagator.Extract(context.Background(), carrier)
+	return trace.SpanContextFromContext(ctx)
+}
+
+// RecordError marks the span as failed
+func RecordError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
@@ -2,44 +2,103 @@ package worker
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"strconv"
 
 	dynamodb "github.com/debojitroy/aws-queue-tasks-consume/internal/services/aws/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
-	color "github.com/fatih/color"
+	sqs "github.com/debojitroy/aws-queue-tasks-consume/internal/services/aws/sqs"
+	ledger "github.com/debojitroy/aws-queue-tasks-consume/internal/services/ledger"
 )
 
-var cConsumer = color.New(color.FgHiGreen)
+// EntityMessageConsumer decrements the message count of the entity the
+// message belongs to. Logging and attribute validation are expected to be
+// provided by sqs middlewares.
+func EntityMessageConsumer(ctx context.Context, mc *sqs.MessageContext) error {
+	if mc.Counters == nil {
+		return fmt.Errorf("no counter store configured")
+	}
 
-func EntityMessageConsumer(ctx context.Context, msg *types.Message, region string, tableName string) error {
-	cConsumer.Println("##########################################################")
-	cConsumer.Printf("Message: %s \n", *msg.Body)
-	entity_id, ok := msg.MessageAttributes["entity_id"]
+	runId := mc.Message.RunId()
+	if runId == "" {
+		return sqs.NewInvalidMessageError("message has no run id")
+	}
 
-	if !ok {
-		cConsumer.Println("Entity ID is nil")
-		return nil
-	} else {
-		cConsumer.Printf("Entity ID: %s \n", *entity_id.StringValue)
+	// Without a ledger there is no telling whether the message was counted
+	if mc.Message.BodyDiscarded {
+		return sqs.NewInvalidMessageError("body of message %d of Entity Id %s is gone, it may not have been counted",
+			mc.Message.Envelope.Sequence, mc.Message.Envelope.EntityId)
 	}
 
-	message_id, ok := msg.MessageAttributes["message_id"]
+	return countedDown(mc, mc.Counters.DecrementMessageCount(ctx, runId, mc.Message.Envelope.EntityId, 1))
+}
 
-	if !ok {
-		cConsumer.Println("Message ID is nil")
+// countedDown interprets the outcome of decrementing the message count. An
+// underflow means every message of the entity was already counted, so the
+// message is a duplicate and is acknowledged. A missing entity can never be
+// counted down and is quarantined, like messages of entities that are no
+// longer processed.
+func countedDown(mc *sqs.MessageContext, err error) error {
+	var underflow *dynamodb.UnderflowError
+	if errors.As(err, &underflow) {
+		mc.Logger.Printf("Message %d of Entity Id %s is a duplicate: %v \n", mc.Message.Envelope.Sequence, underflow.EntityId, err)
 		return nil
-	} else {
-		cConsumer.Printf("Message ID: %s \n", *message_id.StringValue)
 	}
-	cConsumer.Println("###########################################################")
 
-	ddb, err := dynamodb.NewDynamoDBClient(region, tableName)
-	if err != nil {
-		log.Fatalf("Failed to create DynamoDB client: %v \n", err)
-		return err
+	var notFound *dynamodb.NotFoundError
+	if errors.As(err, &notFound) {
+		return sqs.NewInvalidMessageError("%v", err)
 	}
 
-	ddb.DecrementMessageCount(ctx, *entity_id.StringValue, 1)
+	// Messages of cancelled entities are discarded, those of failed
+	// entities are kept for inspection
+	var transition *dynamodb.TransitionError
+	if errors.As(err, &transition) {
+		if transition.From == dynamodb.StatusCancelled {
+			mc.Logger.Printf("Discarding message %d of cancelled Entity Id %s \n", mc.Message.Envelope.Sequence, transition.EntityId)
+			return nil
+		}
+		return sqs.NewInvalidMessageError("%v", err)
+	}
+
+	return err
+}
+
+// NewEntityMessageConsumer returns a handler that decrements the message
+// count of the entity through the ledger, so that redelivered messages are
+// only counted once
+func NewEntityMessageConsumer(l ledger.Ledger) sqs.Handler {
+	return func(ctx context.Context, mc *sqs.MessageContext) error {
+		runId := mc.Message.RunId()
+		entityId := mc.Message.Envelope.EntityId
+		messageId := strconv.Itoa(mc.Message.Envelope.Sequence)
+
+		if runId == "" {
+			return sqs.NewInvalidMessageError("message has no run id")
+		}
+
+		// A message whose body is gone is only acknowledged if it was counted
+		if mc.Message.BodyDiscarded {
+			processed, err := l.Processed(ctx, runId, entityId, messageId)
+			if err != nil {
+				return err
+			}
+			if !processed {
+				return sqs.NewInvalidMessageError("body of message %s of Entity Id %s is gone before it was counted", messageId, entityId)
+			}
+
+			mc.Logger.Printf("Message %s of Entity Id %s was already processed, skipping \n", messageId, entityId)
+			return nil
+		}
 
-	return nil
+		applied, err := l.Consume(ctx, runId, entityId, messageId)
+		if err != nil {
+			return countedDown(mc, err)
+		}
+
+		if !applied {
+			mc.Logger.Printf("Message %s of Entity Id %s was already processed, skipping \n", messageId, entityId)
+		}
+		return nil
+	}
 }
@@ -0,0 +1,115 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"testing"
+
+	sqs "github.com/debojitroy/aws-queue-tasks-consume/internal/services/aws/sqs"
+	ledger "github.com/debojitroy/aws-queue-tasks-consume/internal/services/ledger"
+	message "github.com/debojitroy/aws-queue-tasks-consume/internal/services/message"
+)
+
+// unusedCounters fails the test when the handler bypasses the ledger
+type unusedCounters struct {
+	t *testing.T
+}
+
+func (u unusedCounters) DecrementMessageCount(ctx context.Context, runId string, entityId string, decrementCount int) error {
+	u.t.Errorf("DecrementMessageCount(%s, %s, %d) called, want the ledger to count", runId, entityId, decrementCount)
+	return nil
+}
+
+func messageContext(t *testing.T, runId string, entityId string, sequence int) *sqs.MessageContext {
+	return &sqs.MessageContext{
+		Dependencies: &sqs.Dependencies{
+			Counters: unusedCounters{t: t},
+			Logger:   log.New(io.Discard, "", 0),
+			Metrics:  &sqs.HandlerMetrics{},
+		},
+		Message: &sqs.Message{
+			Envelope: message.NewEnvelope(runId, entityId, sequence, "payload"),
+		},
+		ReceiveCount: 1,
+	}
+}
+
+func TestEntityMessageConsumerAcksDuplicates(t *testing.T) {
+	ctx := context.Background()
+	l := ledger.NewMemoryLedger()
+	l.SetCount("run", "entity", 2)
+	handler := NewEntityMessageConsumer(l)
+
+	for range 2 {
+		if err := handler(ctx, messageContext(t, "run", "entity", 1)); err != nil {
+			t.Fatalf("handler: %v", err)
+		}
+	}
+
+	if count := l.Count("run", "entity"); count != 1 {
+		t.Fatalf("Count = %d, want 1", count)
+	}
+}
+
+func TestEntityMessageConsumerAcksUnderflow(t *testing.T) {
+	ctx := context.Background()
+	l := ledger.NewMemoryLedger()
+	l.SetCount("run", "entity", 0)
+	handler := NewEntityMessageConsumer(l)
+
+	if err := handler(ctx, messageContext(t, "run", "entity", 1)); err != nil {
+		t.Fatalf("handler: %v, want the message acknowledged", err)
+	}
+}
+
+func TestEntityMessageConsumerQuarantinesUnknownEntity(t *testing.T) {
+	handler := NewEntityMessageConsumer(ledger.NewMemoryLedger())
+
+	err := handler(context.Background(), messageContext(t, "run", "entity", 1))
+
+	var invalid *sqs.InvalidMessageError
+	if !errors.As(err, &invalid) {
+		t.Fatalf("handler error = %v, want an InvalidMessageError", err)
+	}
+}
+
+func TestEntityMessageConsumerAcksDiscardedDuplicates(t *testing.T) {
+	ctx := context.Background()
+	l := ledger.NewMemoryLedger()
+	l.SetCount("run", "entity", 2)
+	handler := NewEntityMessageConsumer(l)
+
+	if err := handler(ctx, messageContext(t, "run", "entity", 1)); err != nil {
+		t.Fatalf("handler: %v", err)
+	}
+
+	mc := messageContext(t, "run", "entity", 1)
+	mc.Message.BodyDiscarded = true
+	if err := handler(ctx, mc); err != nil {
+		t.Fatalf("handler: %v, want the duplicate acknowledged", err)
+	}
+
+	if count := l.Count("run", "entity"); count != 1 {
+		t.Fatalf("Count = %d, want 1", count)
+	}
+}
+
+func TestEntityMessageConsumerQuarantinesUncountedDiscarded(t *testing.T) {
+	l := ledger.NewMemoryLedger()
+	l.SetCount("run", "entity", 2)
+	handler := NewEntityMessageConsumer(l)
+
+	mc := messageContext(t, "run", "entity", 1)
+	mc.Message.BodyDiscarded = true
+	err := handler(context.Background(), mc)
+
+	var invalid *sqs.InvalidMessageError
+	if !errors.As(err, &invalid) {
+		t.Fatalf("handler error = %v, want an InvalidMessageError", err)
+	}
+	if count := l.Count("run", "entity"); count != 2 {
+		t.Fatalf("Count = %d, want 2", count)
+	}
+}
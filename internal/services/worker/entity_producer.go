@@ -2,28 +2,73 @@ package worker
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"time"
 
 	dynamodb "github.com/debojitroy/aws-queue-tasks-consume/internal/services/aws/dynamodb"
 	sqs "github.com/debojitroy/aws-queue-tasks-consume/internal/services/aws/sqs"
+	blobstore "github.com/debojitroy/aws-queue-tasks-consume/internal/services/blobstore"
 	entity "github.com/debojitroy/aws-queue-tasks-consume/internal/services/entity"
+	message "github.com/debojitroy/aws-queue-tasks-consume/internal/services/message"
+	scheduler "github.com/debojitroy/aws-queue-tasks-consume/internal/services/scheduler"
+	tracing "github.com/debojitroy/aws-queue-tasks-consume/internal/services/tracing"
 	color "github.com/fatih/color"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type EntityProducerConfig struct {
 	Region    string
 	QueueUrl  string
 	TableName string
+
+	// ClaimCheckStore, when set, receives message bodies larger than
+	// ClaimCheckThreshold bytes
+	ClaimCheckStore     blobstore.Store
+	ClaimCheckThreshold int
+
+	// RunId identifies this invocation. It is the partition key of the
+	// entity items and is carried by every message.
+	RunId string
+	// Codec encodes message envelopes. Defaults to JSON.
+	Codec message.Codec
+
+	// EntityDelay postpones delivery of every entity's messages, and
+	// MessageStagger additionally postpones the n-th message of an entity by
+	// n times the stagger. Delays SQS cannot handle go to SchedulerStore,
+	// without one they fail the run before anything is published.
+	EntityDelay    time.Duration
+	MessageStagger time.Duration
+	SchedulerStore scheduler.Store
+
+	// Retention stamps entity items to expire this long after they were
+	// created (0 to keep them forever). FinishedRetention shortens it for
+	// entities that failed, and is ignored when items are kept forever.
+	Retention         time.Duration
+	FinishedRetention time.Duration
 }
 
 var c = color.New(color.FgHiBlue)
+var cErr = color.New(color.FgRed).Add(color.Bold)
+
+func GenerateRandomEntities(ctx context.Context, num int, config *EntityProducerConfig) error {
+	ctx, runSpan := tracing.Tracer().Start(ctx, "produce run",
+		trace.WithAttributes(attribute.String("run.id", config.RunId), attribute.Int("entity.count", num)))
+	defer runSpan.End()
 
-func GenerateRandomEntities(num int, config *EntityProducerConfig) error {
 	var entities []*entity.Entity
 
 	for range num {
 		newEntity := entity.NewEntity(100)
 
+		newEntity.SetDelay(config.EntityDelay)
+		if config.MessageStagger > 0 {
+			for i := range newEntity.GetMessageCount() {
+				newEntity.SetMessageDelay(i, time.Duration(i)*config.MessageStagger)
+			}
+		}
+
 		entities = append(entities, newEntity)
 	}
 
@@ -32,6 +77,9 @@ func GenerateRandomEntities(num int, config *EntityProducerConfig) error {
 		log.Fatalf("Failed to create DynamoDB client: %v", err)
 		return err
 	}
+	if config.Retention > 0 {
+		ddb.ExpireFinishedAfter(config.FinishedRetention)
+	}
 
 	sqs, err := sqs.NewSQSClient(config.Region, config.QueueUrl)
 	if err != nil {
@@ -39,42 +87,120 @@ func GenerateRandomEntities(num int, config *EntityProducerConfig) error {
 		return err
 	}
 
-	// Publish all entities to the queue
-	for _, record := range entities {
-		c.Printf("Processing Entity Id: %s \n", record.GetId())
-		// Put Item to DynamoDB
-		// Create a new DynamoDB client
-		entityMessageItem := &dynamodb.EntityMessages{
-			EntityId:     record.GetId(),
-			MessageCount: record.GetMessageCount(),
+	sqs.SetRunId(config.RunId)
+	if config.Codec != nil {
+		sqs.UseCodec(config.Codec)
+	}
+
+	if config.SchedulerStore != nil {
+		sqs.EnableScheduler(config.SchedulerStore)
+	} else {
+		// Fail before any message count is stored for messages that could
+		// never be delivered
+		for _, record := range entities {
+			if delay := maxMessageDelay(record); sqs.NeedsScheduler(delay) {
+				err := fmt.Errorf("delay of %s needs a scheduler store", delay)
+				log.Fatalf("Failed to publish messages: %v", err)
+				return err
+			}
 		}
+	}
 
-		c.Printf("Publishing Message count for Entity Id: %s \n", record.GetId())
+	if config.ClaimCheckStore != nil {
+		sqs.EnableClaimCheck(config.ClaimCheckStore, config.ClaimCheckThreshold)
+	}
 
-		err = ddb.PutMessageCount(context.TODO(), *entityMessageItem)
-		if err != nil {
-			log.Fatalf("Failed to put item: %v", err)
+	// Publish all entities to the queue
+	for _, record := range entities {
+		if err := produceEntity(ctx, ddb, sqs, config, record); err != nil {
+			tracing.RecordError(runSpan, err)
 			return err
 		}
+	}
 
-		c.Println("Successfully added item to DynamoDB")
+	return nil
+}
 
-		// Publish the messages to SQS
-		c.Printf("Publishing messages to SQS for Entity Id: %s \n", record.GetId())
+// produceEntity stores the message count of the entity and queues its messages
+func produceEntity(ctx context.Context, ddb *dynamodb.DynamoDBClient, sqs *sqs.SqsClient, config *EntityProducerConfig, record *entity.Entity) (err error) {
+	runId := config.RunId
+
+	ctx, span := tracing.Tracer().Start(ctx, "produce entity",
+		trace.WithAttributes(attribute.String("entity.id", record.GetId())))
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	c.Printf("Processing Entity Id: %s \n", record.GetId())
+
+	// Put Item to DynamoDB
+	entityMessageItem := &dynamodb.EntityMessages{
+		RunId:        runId,
+		EntityId:     record.GetId(),
+		MessageCount: record.GetMessageCount(),
+		TraceParent:  tracing.TraceParent(ctx),
+	}
+	if delay := maxMessageDelay(record); delay > 0 {
+		entityMessageItem.DeliverBy = time.Now().Add(delay).UTC().Format(time.RFC3339Nano)
+	}
+	if config.Retention > 0 {
+		entityMessageItem.ExpiresAt = time.Now().Add(config.Retention).Unix()
+	}
+
+	c.Printf("Publishing Message count for Entity Id: %s \n", record.GetId())
 
-		sqsError := sqs.SendEntityMessages(record)
+	err = ddb.PutMessageCount(ctx, *entityMessageItem)
+	if err != nil {
+		log.Fatalf("Failed to put item: %v", err)
+		return err
+	}
 
-		if sqsError != nil {
-			log.Fatalf("Failed to publish messages to SQS: %v", sqsError)
-			return sqsError
-		} else {
-			c.Println("Successfully published messages to SQS")
+	c.Println("Successfully added item to DynamoDB")
+
+	// Publish the messages to SQS
+	c.Printf("Publishing messages to SQS for Entity Id: %s \n", record.GetId())
+
+	report, sqsError := sqs.SendEntityMessages(ctx, record)
+
+	// Messages that were never queued will never be consumed, so take
+	// them off the stored count
+	if len(report.Unsent) > 0 {
+		for _, unsent := range report.Unsent {
+			cErr.Printf("Unsent message %s for Entity Id %s, Code: %s, Reason: %s \n",
+				unsent.MessageId, record.GetId(), unsent.Code, unsent.Reason)
 		}
 
-		// Add the entity to tracking
-		c.Printf("Adding entity to tracking for Entity Id: %s \n", record.GetId())
-		entity.AddEntity(record.GetId())
+		c.Printf("Correcting Message count for Entity Id: %s by %d \n", record.GetId(), len(report.Unsent))
+		if err := ddb.CorrectMessageCount(ctx, runId, record.GetId(), len(report.Unsent)); err != nil {
+			log.Fatalf("Failed to correct message count: %v", err)
+			return err
+		}
+	}
+
+	if sqsError != nil {
+		if err := ddb.Transition(ctx, runId, record.GetId(), dynamodb.StatusFailed); err != nil {
+			cErr.Printf("Failed to mark Entity Id %s as failed: %v \n", record.GetId(), err)
+		}
+		log.Fatalf("Failed to publish messages to SQS: %v", sqsError)
+		return sqsError
+	} else {
+		c.Printf("Successfully published %d messages to SQS, %d scheduled for later \n", report.Sent, report.Scheduled)
 	}
 
+	// Add the entity to tracking
+	c.Printf("Adding entity to tracking for Entity Id: %s \n", record.GetId())
+	entity.AddEntity(record.GetId())
+
 	return nil
 }
+
+// maxMessageDelay returns the longest delivery delay of the messages of the
+// entity
+func maxMessageDelay(record *entity.Entity) time.Duration {
+	var longest time.Duration
+	for i := range record.GetMessageCount() {
+		longest = max(longest, record.GetMessageDelay(i))
+	}
+	return longest
+}
@@ -1,14 +1,21 @@
 package worker
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"strconv"
-	"syscall"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	dynamodb "github.com/debojitroy/aws-queue-tasks-consume/internal/services/aws/dynamodb"
+	kinesis "github.com/debojitroy/aws-queue-tasks-consume/internal/services/aws/kinesis"
 	entity "github.com/debojitroy/aws-queue-tasks-consume/internal/services/entity"
+	tracing "github.com/debojitroy/aws-queue-tasks-consume/internal/services/tracing"
 	color "github.com/fatih/color"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var cTrack = color.New(color.FgHiCyan)
@@ -18,12 +25,18 @@ type DynamoDBRecord struct {
 	AwsRegion    string `json:"awsRegion"`
 	EventID      string `json:"eventID"`
 	EventName    string `json:"eventName"`
-	UserIdentity any    `json:"userIdentity"`
+	UserIdentity *struct {
+		Type        string `json:"type"`
+		PrincipalID string `json:"principalId"`
+	} `json:"userIdentity"`
 	RecordFormat string `json:"recordFormat"`
 	TableName    string `json:"tableName"`
 	Dynamodb     struct {
 		ApproximateCreationDateTime int64 `json:"ApproximateCreationDateTime"`
 		Keys                        struct {
+			RunID struct {
+				S string `json:"S"`
+			} `json:"run_id"`
 			EntityID struct {
 				S string `json:"S"`
 			} `json:"entity_id"`
@@ -35,6 +48,12 @@ type DynamoDBRecord struct {
 			EntityID struct {
 				S string `json:"S"`
 			} `json:"entity_id"`
+			TraceParent struct {
+				S string `json:"S"`
+			} `json:"trace_parent"`
+			Status struct {
+				S string `json:"S"`
+			} `json:"status"`
 		} `json:"NewImage"`
 		OldImage struct {
 			MessageCount struct {
@@ -50,7 +69,29 @@ type DynamoDBRecord struct {
 	EventSource string `json:"eventSource"`
 }
 
-func MigrationTrackerHandler(record types.Record) error {
+// expiredByTTL reports whether the record is the removal of an item by the
+// DynamoDB TTL process
+func (r *DynamoDBRecord) expiredByTTL() bool {
+	return r.EventName == "REMOVE" && r.UserIdentity != nil &&
+		r.UserIdentity.Type == "Service" && r.UserIdentity.PrincipalID == "dynamodb.amazonaws.com"
+}
+
+// EntityLifecycle moves entities between lifecycle states
+type EntityLifecycle interface {
+	Transition(ctx context.Context, runId string, entityId string, to dynamodb.Status) error
+}
+
+// NewMigrationTrackerHandler returns a Kinesis record handler that marks
+// entities of the run completed once all their messages are processed and
+// calls onComplete once all of them are migrated. Records of other runs are
+// ignored.
+func NewMigrationTrackerHandler(runId string, lifecycle EntityLifecycle, onComplete func()) kinesis.KinesisRecordHandler {
+	return func(record types.Record) error {
+		return migrationTrackerHandler(record, runId, lifecycle, onComplete)
+	}
+}
+
+func migrationTrackerHandler(record types.Record, runId string, lifecycle EntityLifecycle, onComplete func()) error {
 	cTrack.Println("---------------------------")
 
 	dynamoRecord := new(DynamoDBRecord)
@@ -59,10 +100,43 @@ func MigrationTrackerHandler(record types.Record) error {
 	if err != nil {
 		log.Fatalf("Error unmarshalling record: %v", err)
 		return err
-	} else {
-		cTrack.Printf("New Record: %+v \n", dynamoRecord.Dynamodb.NewImage)
 	}
 
+	// Other runs may share the table
+	if dynamoRecord.Dynamodb.Keys.RunID.S != runId {
+		return nil
+	}
+
+	// Deleted items have no new image, and items expired through their TTL
+	// are removed long after they were tracked
+	if dynamoRecord.EventName == "REMOVE" {
+		if dynamoRecord.expiredByTTL() {
+			cTrack.Printf("EntityID: %s expired \n", dynamoRecord.Dynamodb.Keys.EntityID.S)
+		} else {
+			cTrack.Printf("EntityID: %s deleted \n", dynamoRecord.Dynamodb.Keys.EntityID.S)
+		}
+		return nil
+	}
+
+	cTrack.Printf("New Record: %+v \n", dynamoRecord.Dynamodb.NewImage)
+
+	// Link the change back to the producer run that created the entity
+	var links []trace.Link
+	if producer := tracing.SpanContextFromTraceParent(dynamoRecord.Dynamodb.NewImage.TraceParent.S); producer.IsValid() {
+		links = append(links, trace.Link{SpanContext: producer})
+	}
+
+	ctx, span := tracing.Tracer().Start(context.Background(), "track entity",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithLinks(links...),
+		trace.WithAttributes(
+			attribute.String("run.id", runId),
+			attribute.String("entity.id", dynamoRecord.Dynamodb.NewImage.EntityID.S),
+			attribute.String("dynamodb.event_name", dynamoRecord.EventName),
+			attribute.String("messaging.message.id", aws.ToString(record.SequenceNumber)),
+		))
+	defer span.End()
+
 	messageCount, err := strconv.Atoi(dynamoRecord.Dynamodb.NewImage.MessageCount.N)
 
 	if err != nil {
@@ -71,17 +145,30 @@ func MigrationTrackerHandler(record types.Record) error {
 	}
 
 	// If no messages are left, migration is complete
+	span.SetAttributes(attribute.Int("entity.message_count", messageCount))
 	if messageCount == 0 {
-		cTrack.Printf("EntityID: %s, MessageCount: %d completed !!!  \n", dynamoRecord.Dynamodb.NewImage.EntityID.S, messageCount)
-		entity.RemoveEntity(dynamoRecord.Dynamodb.NewImage.EntityID.S)
+		entityId := dynamoRecord.Dynamodb.NewImage.EntityID.S
+		cTrack.Printf("EntityID: %s, MessageCount: %d completed !!!  \n", entityId, messageCount)
+
+		// Completing the entity changes the item again, which shows up here
+		// as a record with the completed status
+		if dynamodb.Status(dynamoRecord.Dynamodb.NewImage.Status.S) != dynamodb.StatusCompleted {
+			var transitionErr *dynamodb.TransitionError
+			if err := lifecycle.Transition(ctx, runId, entityId, dynamodb.StatusCompleted); err != nil && !errors.As(err, &transitionErr) {
+				cTrackErr.Printf("Error completing EntityID: %s: %+v \n", entityId, err)
+				tracing.RecordError(span, err)
+			}
+		}
+
+		entity.RemoveEntity(entityId)
 	}
 
 	// Check if Entities are left
 	if entity.GetEntityCount() == 0 {
 		cTrack.Printf("All Entities are migrated !!! \n")
 
-		// Exit the program
-		syscall.Kill(syscall.Getpid(), syscall.SIGINT)
+		// Let the owner of the lifecycle stop the application
+		onComplete()
 	}
 
 	cTrack.Println("---------------------------")